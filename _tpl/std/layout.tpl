@@ -96,6 +96,7 @@
       <ul>
         <li><a href="/">{{.CanonicalSuffix}}</a></li>
         <li><a href="/lookup">Lookup Domain or Validate JSON</a></li>
+        <li><a href="/status">Status</a></li>
       </ul>
     </div>
     <div id="main">
@@ -3,8 +3,10 @@
 		<form method="POST" action="/lookup" class="lookup-form">
 			<fieldset>
 				<legend>Check a domain name</legend>
-				<input type="text" name="q" value="{{.Query}}" autofocus="autofocus" placeholder="Enter domain name in form d/example or example.bit" size="67" required="required" maxlength="67" pattern="^(d/[a-z0-9_-]+|[a-z0-9_-]+\.bit\.?)$" x-moz-errormessage="Must be in the form d/example or example.bit." />
+				<input type="text" name="q" value="{{.Query}}" autofocus="autofocus" placeholder="Enter domain name in form d/example or example.bit" size="67" required="required" maxlength="255" pattern="^([a-z0-9_-]+/[a-z0-9_-]+|[a-z0-9_-]+(\.[a-z0-9_-]+)+\.?)$" x-moz-errormessage="Must be in the form d/example or example.bit." />
 				<input type="submit" value="Lookup Domain" />
+				<p>To see what the name resolved to in the past, give a block height or a time (e.g. 2020-01-02 or 2020-01-02T15:04:05Z). Imports are resolved as of the same block. This requires Namecoin Core to be run with -namehistory.</p>
+				<input type="text" name="at" value="{{.At}}" placeholder="Block height or time (default: now)" size="40" maxlength="64" />
 				<p>To specify the JSON to validate rather than looking it up via Namecoin, specify it below. (You must still specify the name for the purposes of relative name lookup.)</p>
 				<textarea name="value" class="jsonField" rows="10">{{.JSONValue}}</textarea>
 			</fieldset>
@@ -17,10 +19,15 @@ Invalid name: {{.Query}}
 Namecoin Name:  <span class="rv">{{.NamecoinName}}</span>
 Domain Name:    <span class="rv">{{.DomainName}}</span>
 Bare Name:      <span class="rv">{{.BareName}}</span>
-
+{{if .Historical}}As Of Block:    {{.AtHeight}}
+{{end}}
 Exists:         {{if .ExistenceError}}{{.ExistenceError}}{{else}}Yes{{end}}
-{{if not .ExistenceError}}Expired:        {{.Expired}}{{end}}
-{{if not .ExistenceError}}
+{{if not .ExistenceError}}Expired:        {{.Expired}}{{if .HasMetadata}}
+Last Updated:   block {{.Height}}
+Expires In:     {{.ExpiresIn}} blocks{{end}}{{end}}
+{{if .ValueError}}
+Value Error:    {{.ValueError}}
+{{else if not .ExistenceError}}
 Valid:          {{.Valid}}
 
 Raw Value:
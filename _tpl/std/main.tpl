@@ -61,6 +61,9 @@
 {{end}}    stub-prime: yes</pre>
 		{{if .HasDNSSEC}}<p>You will need to place the {{.CanonicalSuffix}} trust anchor (a DS record) in <code>/etc/unbound/keys/{{.CanonicalSuffix}}.key</code>. See <a href="#dnssec">DNSSEC</a>.</p>{{end}}
 		<p>See the <a href="http://www.unbound.net/">Unbound</a> documentation for information on setting up Unbound.</p>
+		<p>Ready-to-use configuration pointing directly at this server{{if .HasDNSSEC}}, including the trust anchor,{{end}} is available for
+		   <a href="/resolverconf?format=unbound">Unbound</a>, <a href="/resolverconf?format=bind">BIND</a>,
+		   <a href="/resolverconf?format=knot">Knot Resolver</a> and <a href="/resolverconf?format=dnsmasq">dnsmasq</a>.</p>
 
 		<a name="caveats"></a>
 		<h2>Caveats</h2>
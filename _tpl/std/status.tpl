@@ -0,0 +1,23 @@
+{{define "Main"}}<h1>Status</h1>
+		<h2>Names</h2>
+		<pre>
+Source:                {{if .NameSnapshot}}Snapshot file {{.NameSnapshot}}{{else}}Namecoin Core{{end}}
+Block Height:          {{if .TipHash}}{{.TipHeight}}{{else}}Unknown{{end}}
+Block Hash:            {{if .TipHash}}{{.TipHash}}{{else}}Unknown{{end}}
+</pre>
+		<h2>Name Cache</h2>
+		<pre>
+Stream Isolation IDs:  {{.Cache.Isolations}}
+Cached Names:          {{.Cache.Names}}
+Cached Parsed Values:  {{.Cache.ParsedNames}}
+Cached Nonexistent:    {{.Cache.NegativeNames}}
+
+Hits:                  {{.Cache.Hits}}
+Nonexistent Hits:      {{.Cache.NegativeHits}}
+Misses:                {{.Cache.Misses}}
+Stale Hits:            {{.Cache.StaleHits}}
+
+Isolation IDs Evicted: {{.Cache.IsolationsEvicted}}
+Isolation IDs Expired: {{.Cache.IsolationsExpired}}
+</pre>
+{{end}}
@@ -1,7 +1,7 @@
 package backend
 
 import "github.com/miekg/dns"
-import "github.com/golang/groupcache/lru"
+import "github.com/golang/groupcache/singleflight"
 import "gopkg.in/hlandau/madns.v2/merr"
 import "github.com/namecoin/ncdns/namecoin"
 import "github.com/namecoin/ncdns/util"
@@ -9,6 +9,7 @@ import "github.com/namecoin/ncdns/ncdomain"
 import "github.com/namecoin/ncdns/tlshook"
 import "github.com/hlandau/xlog"
 import "sync"
+import "container/list"
 import "fmt"
 import "net"
 import "net/mail"
@@ -18,25 +19,115 @@ import "time"
 // Provides an abstract zone file for the Namecoin .bit TLD.
 type Backend struct {
 	//s *Server
-	nc *namecoin.Client
-	// caches map keys are stream isolation ID's; items are of type *Domain
-	caches     map[string]*lru.Cache
+	src NameSource
+	// caches map keys are stream isolation ID's. cacheLRU orders the same
+	// items by last use, most recent first.
+	caches     map[string]*isolationCache
+	cacheLRU   *list.List
+	cacheStats CacheStats
 	cacheMutex sync.Mutex
 	cfg        Config
+
+	// Deduplicates concurrent namecoind queries for the same name and stream
+	// isolation ID.
+	inflight singleflight.Group
+
+	failMutex         sync.Mutex
+	lastSourceFailure time.Time
+
+	// Chain tip as last seen by watchChainTip. tipGeneration is incremented
+	// every time the tip changes; cache entries from an older generation are
+	// considered stale.
+	tipMutex      sync.Mutex
+	tipHeight     int64
+	tipHash       string
+	tipGeneration uint64
+	tipSerial     uint32
+
+	// The chain tip for which tipSerial was recorded in SerialFile, if it
+	// was loaded from there and the tip hasn't been observed since.
+	serialFileHash string
+
+	// Closed by Close to stop background goroutines.
+	quit      chan struct{}
+	closeOnce sync.Once
 }
 
 var log, Log = xlog.New("ncdns.backend")
 
 // Backend configuration.
 type Config struct {
+	// Source of name values. If nil, NamecoinConn is used.
+	NameSource NameSource
+
+	// Namecoin Core RPC client to use if NameSource is not set.
 	NamecoinConn *namecoin.Client
 
 	// Timeout (in milliseconds) for Namecoin RPC requests
 	NamecoinTimeout int
 
-	// Maximum entries to permit in name cache.
+	// Number of blocks after a name expires during which it continues to be
+	// served. 0 means expired names are treated as nonexistent at once.
+	// Names whose value couldn't be decoded are always nonexistent.
+	ExpiryGracePeriod int
+
+	// Maximum entries to permit in name cache, per stream isolation ID.
 	CacheMaxEntries int
 
+	// Maximum number of stream isolation ID's to keep caches for. When
+	// exceeded, the caches of the least recently used ID are discarded. 0
+	// means no limit.
+	CacheMaxIsolations int
+
+	// Time (in seconds) after which the caches of an unused stream isolation
+	// ID are discarded. 0 means never.
+	CacheIsolationIdleTimeout int
+
+	// Maximum entries to permit in the negative (NXDOMAIN) cache, per stream
+	// isolation ID. 0 disables negative caching.
+	NegativeCacheMaxEntries int
+
+	// Maximum age (in seconds) of a name cache entry. Entries older than this
+	// are refetched even if the chain tip has not changed. 0 means no limit.
+	CacheMaxAge int
+
+	// Time (in seconds) for which name values are retained after being
+	// fetched, so that they can be served if namecoind later fails or times
+	// out (RFC 8767). Records served this way have a TTL of 30 seconds. 0
+	// disables serving stale values.
+	ServeStale int
+
+	// Interval (in milliseconds) at which to poll Namecoin for the chain tip.
+	// Whenever the tip changes (a new block or a reorganization), all cached
+	// names are refetched on next use. 0 disables polling.
+	ChainTipPollInterval int
+
+	// If set, called whenever a new chain tip is observed, including the
+	// first. It is called from the polling goroutine and must not block.
+	OnChainTipChange func(height int64, hash string)
+
+	// SOA timers (in seconds) to advertise at the zone apex. Zero values
+	// select the defaults of 600, 600, 7200 and 600 respectively. Per RFC
+	// 2308, SOAMinTTL is also how long nonexistent names are cached.
+	SOARefresh int
+	SOARetry   int
+	SOAExpire  int
+	SOAMinTTL  int
+
+	// If set, the path of a file in which the SOA serial is recorded whenever
+	// it changes, so that it never decreases across restarts, even if the
+	// chain has meanwhile been reorganized to a lower height.
+	SerialFile string
+
+	// TTL (in seconds) of the SOA, NS and vanity A/AAAA records at the zone
+	// apex, and of the records of the pseudo-hostname under x--nmc. 0 selects
+	// the default of 86400.
+	ApexTTL int
+
+	// Suffixes under which to serve Namecoin names, and the namespaces to
+	// take them from. If empty, util.DefaultAnchors is used.
+	Anchors []util.Anchor
+
 	// Nameservers to advertise at zone apex. The first is considered the primary.
 	// If empty, a pseudo-hostname resolvable to SelfIP is used.
 	CanonicalNameservers []string
@@ -52,8 +143,17 @@ type Config struct {
 	// Hostmaster in e. mail form (e.g. "hostmaster@example.com").
 	Hostmaster string
 
+	// If true, an SOA is synthesized at the apex of every domain (e.g.
+	// "example.bit."), so that each domain is answered as a zone of its own.
+	// The hostmaster is taken from the domain's "email" field, falling back to
+	// Hostmaster, and the serial is the height at which the name was last
+	// updated. Domains delegated with NS records get no SOA.
+	PerDomainSOA bool
+
 	// Map names (like "d/example") to strings containing JSON values. Used to provide
-	// fake names for testing purposes. You don't need to use this.
+	// fake names for testing purposes. You don't need to use this. The names
+	// take precedence over those of the name source; a value of "NX" is
+	// ignored, so the name is looked up in the name source as usual.
 	FakeNames map[string]string
 }
 
@@ -62,9 +162,42 @@ func New(cfg *Config) (backend *Backend, err error) {
 	b := &Backend{}
 
 	b.cfg = *cfg
-	b.nc = b.cfg.NamecoinConn
+	b.src = b.cfg.NameSource
+	if b.src == nil && b.cfg.NamecoinConn != nil {
+		b.src = b.cfg.NamecoinConn
+	}
+
+	if len(b.cfg.FakeNames) > 0 {
+		fake := StaticSource{}
+		for k, v := range b.cfg.FakeNames {
+			if v != "NX" {
+				fake[k] = v
+			}
+		}
+
+		if b.src == nil {
+			b.src = fake
+		} else {
+			b.src = MultiSource{fake, b.src}
+		}
+	}
+	if b.src == nil {
+		return nil, fmt.Errorf("no name source configured")
+	}
+
+	b.caches = make(map[string]*isolationCache)
+	b.cacheLRU = list.New()
+	b.quit = make(chan struct{})
 
-	b.caches = make(map[string]*lru.Cache)
+	if len(b.cfg.Anchors) == 0 {
+		b.cfg.Anchors = util.DefaultAnchors
+	}
+
+	setDefault(&b.cfg.SOARefresh, 600)
+	setDefault(&b.cfg.SOARetry, 600)
+	setDefault(&b.cfg.SOAExpire, 7200)
+	setDefault(&b.cfg.SOAMinTTL, 600)
+	setDefault(&b.cfg.ApexTTL, 86400)
 
 	hostmaster, err := convertEmail(b.cfg.Hostmaster)
 	if err != nil {
@@ -72,11 +205,36 @@ func New(cfg *Config) (backend *Backend, err error) {
 	}
 	b.cfg.Hostmaster = hostmaster
 
+	b.tipSerial, b.serialFileHash, err = readSerial(b.cfg.SerialFile)
+	if err != nil {
+		return
+	}
+
+	if ts, ok := b.src.(ChainTipSource); ok && b.cfg.ChainTipPollInterval > 0 {
+		go b.watchChainTip(ts)
+	}
+
 	backend = b
 
 	return
 }
 
+// Close stops the backend's background goroutines. The backend must not be
+// used afterwards.
+func (b *Backend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.quit)
+	})
+
+	return nil
+}
+
+func setDefault(v *int, def int) {
+	if *v <= 0 {
+		*v = def
+	}
+}
+
 func convertEmail(email string) (string, error) {
 	if email == "" {
 		return ".", nil
@@ -115,6 +273,84 @@ func (b *Backend) Lookup(qname, streamIsolationID string) (rrs []dns.RR, err err
 	return btx.Do()
 }
 
+// LookupResult describes the outcome of a lookup in enough detail to prove,
+// with DNSSEC, that a name or record doesn't exist.
+type LookupResult struct {
+	// The records at the queried name. Empty if the name doesn't exist, or
+	// if it exists but has no records (NODATA).
+	RRs []dns.RR
+
+	// True if the queried name doesn't exist (NXDOMAIN).
+	NXDomain bool
+
+	// The longest existing name which is the queried name or one of its
+	// ancestors (RFC 4592 section 3.3.1). If the queried name exists other
+	// than by wildcard synthesis, this is the queried name itself.
+	ClosestEncloser string
+
+	// If RRs were synthesized from a wildcard, the owner name of the wildcard
+	// (e.g. "*.example.bit."). Otherwise empty.
+	Wildcard string
+
+	// If the queried name is at or beneath a zone cut (a name with NS
+	// records), the name of the cut. RRs then hold a referral: the NS
+	// records, any DS records, and glue addresses for nameservers named
+	// within the domain.
+	Delegation string
+}
+
+// NextCloser returns the name one label longer than the closest encloser on
+// the way to qname (RFC 5155 section 1.3), or "" if qname is the closest
+// encloser.
+func (r *LookupResult) NextCloser(qname string) string {
+	qname = dns.Fqdn(qname)
+	if r.ClosestEncloser == "" || dns.CountLabel(qname) <= dns.CountLabel(r.ClosestEncloser) {
+		return ""
+	}
+
+	labels := dns.SplitDomainName(qname)
+	n := len(labels) - dns.CountLabel(r.ClosestEncloser)
+	return dns.Fqdn(strings.Join(labels[n-1:], "."))
+}
+
+// LookupDetail is like Lookup, but describes the outcome in more detail.
+// Nonexistent names are reported by setting NXDomain rather than by
+// returning merr.ErrNoSuchDomain.
+func (b *Backend) LookupDetail(qname, streamIsolationID string) (*LookupResult, error) {
+	err := lookupReadyError()
+	if err != nil {
+		return nil, err
+	}
+
+	btx := &btx{}
+	btx.b = b
+	btx.qname = qname
+	btx.streamIsolationID = streamIsolationID
+	rrs, err := btx.Do()
+
+	res := &LookupResult{
+		RRs:             rrs,
+		ClosestEncloser: btx.closestEncloser,
+		Wildcard:        btx.wildcard,
+		Delegation:      btx.delegation,
+	}
+
+	if err == merr.ErrNoSuchDomain {
+		res.NXDomain = true
+		return res, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.ClosestEncloser == "" {
+		res.ClosestEncloser = dns.Fqdn(qname)
+	}
+
+	return res, nil
+}
+
 // Things to keep track of while processing a query.
 type btx struct {
 	b     *Backend
@@ -123,6 +359,15 @@ type btx struct {
 	streamIsolationID string
 
 	subname, basename, rootname string
+
+	// The anchor rootname begins with.
+	anchor *util.Anchor
+
+	// Set when the queried name doesn't exist, or is synthesized from a
+	// wildcard; see LookupResult.
+	closestEncloser string
+	wildcard        string
+	delegation      string
 }
 
 func (tx *btx) Do() (rrs []dns.RR, err error) {
@@ -130,10 +375,10 @@ func (tx *btx) Do() (rrs []dns.RR, err error) {
 	// basename is the name directly before that, and subname is every name
 	// before that. So "a.b.example.bit.suffix.xyz." would have a subname
 	// of "a.b", a basename of "example" and a rootname of "bit.suffix.xyz".
-	tx.subname, tx.basename, tx.rootname, err = tx.determineDomain()
+	tx.subname, tx.basename, tx.rootname, tx.anchor, err = tx.determineDomain()
 	if err != nil {
-		// We get an error if '.bit.' does not appear anywhere. In that case
-		// we're not authoritative for the query in question and error out.
+		// We get an error if no anchor (e.g. '.bit.') appears anywhere. In that
+		// case we're not authoritative for the query in question and error out.
 		return
 	}
 
@@ -159,11 +404,16 @@ func (tx *btx) Do() (rrs []dns.RR, err error) {
 
 	// If we have reached this point the query must be a normal user query.
 	rrs, err = tx.doUserDomain()
+	if err == merr.ErrNoSuchDomain && tx.closestEncloser == "" {
+		// The Namecoin name itself doesn't exist.
+		tx.closestEncloser = dns.Fqdn(tx.rootname)
+	}
+
 	return
 }
 
-func (tx *btx) determineDomain() (subname, basename, rootname string, err error) {
-	return util.SplitDomainByFloatingAnchor(tx.qname, "bit")
+func (tx *btx) determineDomain() (subname, basename, rootname string, anchor *util.Anchor, err error) {
+	return util.SplitDomainByFloatingAnchors(tx.qname, tx.b.cfg.Anchors)
 }
 
 func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
@@ -175,17 +425,17 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 	soa := &dns.SOA{
 		Hdr: dns.RR_Header{
 			Name:   dns.Fqdn(tx.rootname),
-			Ttl:    86400,
+			Ttl:    uint32(tx.b.cfg.ApexTTL),
 			Class:  dns.ClassINET,
 			Rrtype: dns.TypeSOA,
 		},
 		Ns:      nss[0],
 		Mbox:    tx.b.cfg.Hostmaster,
-		Serial:  1,
-		Refresh: 600,
-		Retry:   600,
-		Expire:  7200,
-		Minttl:  600,
+		Serial:  tx.b.SOASerial(),
+		Refresh: uint32(tx.b.cfg.SOARefresh),
+		Retry:   uint32(tx.b.cfg.SOARetry),
+		Expire:  uint32(tx.b.cfg.SOAExpire),
+		Minttl:  uint32(tx.b.cfg.SOAMinTTL),
 	}
 
 	rrs = make([]dns.RR, 0, 1+len(nss)+len(tx.b.cfg.VanityIPs))
@@ -194,7 +444,7 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 		ns := &dns.NS{
 			Hdr: dns.RR_Header{
 				Name:   dns.Fqdn(tx.rootname),
-				Ttl:    86400,
+				Ttl:    uint32(tx.b.cfg.ApexTTL),
 				Class:  dns.ClassINET,
 				Rrtype: dns.TypeNS,
 			},
@@ -209,7 +459,7 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 			a := &dns.A{
 				Hdr: dns.RR_Header{
 					Name:   dns.Fqdn(tx.rootname),
-					Ttl:    86400,
+					Ttl:    uint32(tx.b.cfg.ApexTTL),
 					Class:  dns.ClassINET,
 					Rrtype: dns.TypeA,
 				},
@@ -220,7 +470,7 @@ func (tx *btx) doRootDomain() (rrs []dns.RR, err error) {
 			a := &dns.AAAA{
 				Hdr: dns.RR_Header{
 					Name:   dns.Fqdn(tx.rootname),
-					Ttl:    86400,
+					Ttl:    uint32(tx.b.cfg.ApexTTL),
 					Class:  dns.ClassINET,
 					Rrtype: dns.TypeAAAA,
 				},
@@ -245,7 +495,7 @@ func (tx *btx) doMetaDomain() (rrs []dns.RR, err error) {
 			&dns.A{
 				Hdr: dns.RR_Header{
 					Name:   dns.Fqdn("this." + tx.basename + "." + tx.rootname),
-					Ttl:    86400,
+					Ttl:    uint32(tx.b.cfg.ApexTTL),
 					Class:  dns.ClassINET,
 					Rrtype: dns.TypeA,
 				},
@@ -258,7 +508,7 @@ func (tx *btx) doMetaDomain() (rrs []dns.RR, err error) {
 			&dns.CNAME{
 				Hdr: dns.RR_Header{
 					Name:   dns.Fqdn("aia." + tx.basename + "." + tx.rootname),
-					Ttl:    86400,
+					Ttl:    uint32(tx.b.cfg.ApexTTL),
 					Class:  dns.ClassINET,
 					Rrtype: dns.TypeCNAME,
 				},
@@ -273,12 +523,12 @@ func (tx *btx) doMetaDomain() (rrs []dns.RR, err error) {
 }
 
 func (tx *btx) doUserDomain() (rrs []dns.RR, err error) {
-	ncname, err := util.BasenameToNamecoinKey(tx.basename)
+	ncname, err := tx.anchor.BasenameToNamecoinKey(tx.basename)
 	if err != nil {
 		return
 	}
 
-	d, err := tx.b.getNamecoinEntry(ncname, tx.streamIsolationID)
+	d, stale, err := tx.b.getNamecoinEntry(ncname, tx.streamIsolationID)
 	if err != nil {
 		return nil, err
 	}
@@ -288,116 +538,331 @@ func (tx *btx) doUserDomain() (rrs []dns.RR, err error) {
 		return nil, err
 	}
 
+	if tx.b.cfg.PerDomainSOA && tx.subname == "" && len(d.ncv.NS) == 0 {
+		rrs = append(rrs, tx.domainSOA(d))
+	}
+
+	if stale {
+		for _, rr := range rrs {
+			if rr.Header().Ttl > staleTTL {
+				rr.Header().Ttl = staleTTL
+			}
+		}
+	}
+
 	return rrs, nil
 }
 
+// Returns the SOA synthesized for the apex of a domain.
+func (tx *btx) domainSOA(d *domain) *dns.SOA {
+	nss := tx.b.cfg.CanonicalNameservers
+	if len(nss) == 0 {
+		nss = []string{dns.Fqdn("this.x--nmc." + tx.rootname)}
+	}
+
+	mbox := tx.b.cfg.Hostmaster
+	if d.ncv.Hostmaster != "" {
+		m, err := convertEmail(d.ncv.Hostmaster)
+		if err == nil {
+			mbox = m
+		}
+	}
+
+	// Names from sources which can't report heights follow the chain tip,
+	// like the zone apex.
+	serial := uint32(d.height)
+	if serial == 0 {
+		serial = tx.b.SOASerial()
+	}
+
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(tx.basename + "." + tx.rootname),
+			Ttl:    uint32(tx.b.cfg.SOAMinTTL),
+			Class:  dns.ClassINET,
+			Rrtype: dns.TypeSOA,
+		},
+		Ns:      nss[0],
+		Mbox:    mbox,
+		Serial:  serial,
+		Refresh: uint32(tx.b.cfg.SOARefresh),
+		Retry:   uint32(tx.b.cfg.SOARetry),
+		Expire:  uint32(tx.b.cfg.SOAExpire),
+		Minttl:  uint32(tx.b.cfg.SOAMinTTL),
+	}
+}
+
 // Keep domains in parsed format.
 type domain struct {
 	ncv *ncdomain.Value
+
+	// The JSON values of every name consulted while parsing ncv, including
+	// the name itself and any "import" or "delegate" targets. A nil value
+	// means the name could not be resolved at the time.
+	deps map[string]*string
+
+	// The block height at which the name was last updated, or 0 if unknown.
+	height int64
 }
 
-func (b *Backend) resolveNameCache(name, streamIsolationID string) *string {
-	b.cacheMutex.Lock()
-	defer b.cacheMutex.Unlock()
+func (b *Backend) getNamecoinEntry(name, streamIsolationID string) (d *domain, stale bool, err error) {
+	generation := b.chainTipGeneration()
+
+	// Try the parsed cache first. If the entry has merely gone stale, check
+	// whether the name or anything it imports has actually changed before
+	// throwing the parsed value away.
+	d, fresh := b.resolveParsedCache(name, streamIsolationID)
+	if d != nil {
+		if fresh {
+			return d, false, nil
+		}
+
+		unchanged, stale, err := b.domainDepsUnchanged(name, d, streamIsolationID)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// If the dependencies could only be checked against stale values,
+		// the parsed value is served without being marked fresh again.
+		if unchanged && stale {
+			return d, true, nil
+		}
+
+		if unchanged {
+			b.addParsedCache(name, d, generation, streamIsolationID)
+			return d, false, nil
+		}
+	}
+
+	v, height, stale, err := b.lookupName(name, streamIsolationID)
+	if err != nil {
+		return nil, false, err
+	}
 
-	cache, ok := b.caches[streamIsolationID]
-	if !ok {
-		return nil
+	d, depsStale, err := b.jsonToDomain(name, v, streamIsolationID)
+	if err != nil {
+		return nil, false, err
 	}
 
-	if dd, ok := cache.Get(name); ok {
-		v := dd.(*string)
+	d.height = height
 
-		return v
+	if stale || depsStale {
+		return d, true, nil
 	}
 
-	return nil
+	b.addParsedCache(name, d, generation, streamIsolationID)
+	return d, false, nil
 }
 
-func (b *Backend) addNamecoinJSONToCache(name string, jsonValue *string, streamIsolationID string) {
-	b.cacheMutex.Lock()
-	defer b.cacheMutex.Unlock()
+// Returns true if every name d depended on still has the value it had when d
+// was parsed, and the name itself hasn't been updated since. An error is
+// returned only if the primary name itself can no longer be resolved. stale
+// is true if any comparison was made against a stale value.
+func (b *Backend) domainDepsUnchanged(name string, d *domain, streamIsolationID string) (unchanged, stale bool, err error) {
+	v, height, stale, err := b.lookupName(name, streamIsolationID)
+	if err != nil {
+		return false, false, err
+	}
+
+	if old := d.deps[name]; old == nil || *old != v || height != d.height {
+		return false, stale, nil
+	}
+
+	for depName, old := range d.deps {
+		if depName == name {
+			continue
+		}
+
+		v, _, depStale, err := b.lookupName(depName, streamIsolationID)
+		stale = stale || depStale
+		if (err != nil) != (old == nil) {
+			return false, stale, nil
+		}
 
-	cache, ok := b.caches[streamIsolationID]
-	if !ok {
-		b.caches[streamIsolationID] = &lru.Cache{
-			MaxEntries: b.cfg.CacheMaxEntries,
+		if err == nil && *old != v {
+			return false, stale, nil
 		}
-		cache = b.caches[streamIsolationID]
 	}
 
-	cache.Add(name, jsonValue)
+	return true, stale, nil
 }
 
-func (b *Backend) getNamecoinEntry(name, streamIsolationID string) (*domain, error) {
-	// Try the cache first
-	v := b.resolveNameCache(name, streamIsolationID)
+// Resolves a name to its JSON value and the height at which it was last
+// updated (0 if the name source doesn't say), consulting the negative and
+// name caches before falling back to namecoind.
+//
+// If serving stale values is enabled and namecoind fails, an expired cached
+// value may be returned instead; stale is then true. Per RFC 8767, after a
+// failure namecoind is not retried for staleRecheckInterval, and stale values
+// are returned immediately during that time.
+func (b *Backend) lookupName(name, streamIsolationID string) (jsonValue string, height int64, stale bool, err error) {
+	if b.resolveNegativeCache(name, streamIsolationID) {
+		return "", 0, false, merr.ErrNoSuchDomain
+	}
 
-	// If the cache misses, resolve it via namecoind
-	if v == nil {
-		vv, err := b.resolveName(name, streamIsolationID)
-		if err != nil {
-			return nil, err
-		}
+	staleValue, fresh := b.resolveNameCache(name, streamIsolationID)
+	if staleValue != nil && fresh {
+		return staleValue.jsonValue, staleValue.height, false, nil
+	}
 
-		v = &vv
-		b.addNamecoinJSONToCache(name, v, streamIsolationID)
+	if staleValue != nil && b.sourceRecentlyFailed() {
+		b.noteStaleHit()
+		return staleValue.jsonValue, staleValue.height, true, nil
 	}
 
-	d, err := b.jsonToDomain(name, *v, streamIsolationID)
-	if err != nil {
-		return nil, err
+	// The generation is sampled before the query so that a value fetched
+	// while the tip moves is never recorded as belonging to the new tip.
+	generation := b.chainTipGeneration()
+
+	// Concurrent misses for the same name share a single query and its
+	// result. Names never contain NUL, so the key is unambiguous.
+	v, err := b.inflight.Do(name+"\x00"+streamIsolationID, func() (interface{}, error) {
+		r := b.resolveName(name, streamIsolationID, generation)
+		return r, r.err
+	})
+	if err == nil {
+		r := v.(nameResult)
+		return r.jsonValue, r.height, false, nil
+	}
+
+	// A name which no longer exists is never served stale.
+	if staleValue != nil && err != merr.ErrNoSuchDomain {
+		log.Infof("serving stale value for %s: %v", name, err)
+		b.noteStaleHit()
+		return staleValue.jsonValue, staleValue.height, true, nil
 	}
 
-	return d, nil
+	return "", 0, false, err
 }
 
-func (b *Backend) resolveName(name, streamIsolationID string) (jsonValue string, err error) {
-	if fv, ok := b.cfg.FakeNames[name]; ok {
-		if fv == "NX" {
-			return "", merr.ErrNoSuchDomain
-		}
-		return fv, nil
-	}
+type nameResult struct {
+	jsonValue string
+	height    int64
+	err       error
+}
 
+// Queries the name source. The result is recorded in the cache when it
+// arrives, even if that is after the query has timed out, so that a slow
+// query still refreshes the cache for later lookups.
+func (b *Backend) resolveName(name, streamIsolationID string, generation uint64) nameResult {
 	// The rpcclient package has quite a long timeout, far in excess of standard
 	// DNS timeouts. We need to return an error response rapidly if we can't
 	// query the backend. Be generous with the timeout as responses from the
 	// Namecoin JSON-RPC seem sluggish sometimes.
-	result := make(chan struct{}, 1)
+	result := make(chan nameResult, 1)
 	go func() {
-		jsonValue, err = b.nc.NameQuery(name, streamIsolationID)
-		log.Errore(err, "failed to query namecoin")
-		result <- struct{}{}
+		v, height, err := b.queryName(name, streamIsolationID)
+
+		switch {
+		case err == nil:
+			b.addNamecoinJSONToCache(name, v, height, generation, streamIsolationID)
+		case err == merr.ErrNoSuchDomain:
+			b.addNegativeCache(name, generation, streamIsolationID)
+		default:
+			log.Errore(err, "failed to query namecoin")
+			b.noteSourceFailure()
+		}
+
+		result <- nameResult{v, height, err}
 	}()
 
 	select {
-	case <-result:
-		return
+	case r := <-result:
+		return r
 	case <-time.After(time.Duration(b.cfg.NamecoinTimeout) * time.Millisecond):
-		return "", fmt.Errorf("timeout")
+		b.noteSourceFailure()
+		return nameResult{err: fmt.Errorf("timeout")}
+	}
+}
+
+// Queries the name source for the value of a name and the height at which it
+// was last updated, treating names which have expired (beyond the grace
+// period) or whose value couldn't be decoded as nonexistent.
+func (b *Backend) queryName(name, streamIsolationID string) (string, int64, error) {
+	v, md, err := queryMetadata(b.src, name, streamIsolationID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if md.ValueError != "" {
+		log.Debugf("treating %s as nonexistent: couldn't decode its value: %s", name, md.ValueError)
+		return "", 0, merr.ErrNoSuchDomain
 	}
+
+	if b.expired(md.Expired, md.ExpiresIn) {
+		return "", 0, merr.ErrNoSuchDomain
+	}
+
+	return v, md.Height, nil
+}
+
+// ResolveName returns the current value of a Namecoin name (e.g.
+// "d/example"), bypassing the caches. As when answering queries, names which
+// have expired beyond the grace period, or whose value couldn't be decoded,
+// don't exist. It is suitable as the resolve function of ncdomain.ParseValue.
+func (b *Backend) ResolveName(name string) (string, error) {
+	v, _, err := b.queryName(name, "")
+	return v, err
+}
+
+// Returns true if a name which expires in expiresIn blocks should be treated
+// as nonexistent, taking the grace period into account.
+func (b *Backend) expired(expired bool, expiresIn int64) bool {
+	return expired && expiresIn <= -int64(b.cfg.ExpiryGracePeriod)
+}
+
+// How long after a failed query stale values are served without first
+// retrying namecoind, per RFC 8767.
+const staleRecheckInterval = 30 * time.Second
+
+// TTL of records served from stale values, per RFC 8767.
+const staleTTL = 30
+
+func (b *Backend) noteSourceFailure() {
+	b.failMutex.Lock()
+	defer b.failMutex.Unlock()
+
+	b.lastSourceFailure = time.Now()
+}
+
+func (b *Backend) sourceRecentlyFailed() bool {
+	b.failMutex.Lock()
+	defer b.failMutex.Unlock()
+
+	return time.Since(b.lastSourceFailure) < staleRecheckInterval
 }
 
-func (b *Backend) jsonToDomain(name, jsonValue, streamIsolationID string) (*domain, error) {
-	d := &domain{}
+// Parses a JSON value. stale is true if any imported name was resolved
+// using a stale value.
+func (b *Backend) jsonToDomain(name, jsonValue, streamIsolationID string) (d *domain, stale bool, err error) {
+	d = &domain{
+		deps: map[string]*string{name: &jsonValue},
+	}
 
 	resolveExtraIsolated := func(n string) (string, error) {
-		return b.resolveExtraName(n, streamIsolationID)
+		v, depStale, err := b.resolveExtraName(n, streamIsolationID)
+		stale = stale || depStale
+		if err != nil {
+			d.deps[n] = nil
+		} else {
+			d.deps[n] = &v
+		}
+		return v, err
 	}
 
 	v := ncdomain.ParseValue(name, jsonValue, resolveExtraIsolated, nil)
 	if v == nil {
-		return nil, fmt.Errorf("couldn't parse value")
+		return nil, false, fmt.Errorf("couldn't parse value")
 	}
 
 	d.ncv = v
 
-	return d, nil
+	return d, stale, nil
 }
 
-func (b *Backend) resolveExtraName(name, streamIsolationID string) (jsonValue string, err error) {
-	return b.resolveName(name, streamIsolationID)
+func (b *Backend) resolveExtraName(name, streamIsolationID string) (jsonValue string, stale bool, err error) {
+	jsonValue, _, stale, err = b.lookupName(name, streamIsolationID)
+	return
 }
 
 func (tx *btx) doUnderDomain(d *domain) (rrs []dns.RR, err error) {
@@ -410,7 +875,14 @@ func (tx *btx) doUnderDomain(d *domain) (rrs []dns.RR, err error) {
 }
 
 func (tx *btx) addAnswersUnderNCValue(rncv *ncdomain.Value, subname string) (rrs []dns.RR, err error) {
-	ncv, sn, err := tx.findNCValue(rncv, subname, nil /*hasNS*/)
+	// Nothing at or beneath a zone cut is answered from the value, other than
+	// the referral itself.
+	cut, sn, err := tx.findNCValue(rncv, subname, hasNS)
+	if err == nil {
+		return tx.addReferral(rncv, cut, sn)
+	}
+
+	ncv, sn, err := tx.findNCValue(rncv, subname, nil)
 	if err != nil {
 		return
 	}
@@ -418,6 +890,67 @@ func (tx *btx) addAnswersUnderNCValue(rncv *ncdomain.Value, subname string) (rrs
 	return tx.addAnswersUnderNCValueActual(ncv, sn)
 }
 
+func hasNS(ncv *ncdomain.Value) bool {
+	return len(ncv.NS) > 0
+}
+
+// Returns a referral to the nameservers of the zone cut at cut, whose name
+// relative to the domain is sn. Glue addresses are taken from the domain's
+// value, rncv, for every nameserver named within the domain.
+func (tx *btx) addReferral(rncv, cut *ncdomain.Value, sn string) (rrs []dns.RR, err error) {
+	owner := tx.absName(sn)
+	apex := tx.absName("")
+	tx.delegation = owner
+	tx.closestEncloser = owner
+
+	// The NS and DS records of the cut.
+	rrs, err = cut.RRs(nil, owner, apex)
+	if err != nil {
+		return nil, err
+	}
+
+	var glue []dns.RR
+	for _, rr := range rrs {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !dns.IsSubDomain(apex, ns.Ns) {
+			continue
+		}
+
+		gv := glueValue(rncv, strings.TrimSuffix(ns.Ns, apex))
+		if gv == nil {
+			continue
+		}
+
+		grrs, _ := gv.RRs(nil, ns.Ns, apex)
+		for _, grr := range grrs {
+			switch grr.Header().Rrtype {
+			case dns.TypeA, dns.TypeAAAA:
+				glue = append(glue, grr)
+			}
+		}
+	}
+
+	return append(rrs, glue...), nil
+}
+
+// Finds the value for a name relative to a domain (e.g. "ns1." or ""),
+// without applying wildcards. Glue is taken from beneath zone cuts too, since
+// the nameservers of a delegation are commonly named within it.
+func glueValue(ncv *ncdomain.Value, subname string) *ncdomain.Value {
+	for subname != "" {
+		head, rest := util.SplitDomainHead(subname)
+
+		sub, ok := ncv.Map[head]
+		if !ok {
+			return nil
+		}
+
+		ncv, subname = sub, rest
+	}
+
+	return ncv
+}
+
 func (tx *btx) findNCValue(ncv *ncdomain.Value, subname string, shortCircuitFunc func(curNCV *ncdomain.Value) bool) (xncv *ncdomain.Value, sn string, err error) {
 	return tx._findNCValue(ncv, subname, "", 0, shortCircuitFunc)
 }
@@ -433,13 +966,32 @@ func (tx *btx) _findNCValue(ncv *ncdomain.Value, isubname, subname string, depth
 		head, rest := util.SplitDomainHead(isubname)
 
 		sub, ok := ncv.Map[head]
-		if !ok {
-			sub, ok = ncv.Map["*"]
-			if !ok {
-				return nil, "", merr.ErrNoSuchDomain
+		if ok {
+			return tx._findNCValue(sub, rest, head+"."+subname, depth+1, shortCircuitFunc)
+		}
+
+		// The current name is the closest encloser. Per RFC 4592, its
+		// wildcard, if any, matches every name beneath it which doesn't exist,
+		// however many labels deep; wildcards further down are not consulted.
+		wc, ok := ncv.Map["*"]
+
+		// When looking for a zone cut, a missing name means there isn't one,
+		// unless the wildcard matching it has one.
+		if shortCircuitFunc != nil {
+			if ok && shortCircuitFunc(wc) {
+				return wc, isubname + "." + subname, nil
 			}
+
+			return nil, subname, merr.ErrNoSuchDomain
 		}
-		return tx._findNCValue(sub, rest, head+"."+subname, depth+1, shortCircuitFunc)
+
+		tx.closestEncloser = tx.absName(subname)
+		if !ok {
+			return nil, "", merr.ErrNoSuchDomain
+		}
+
+		tx.wildcard = tx.absName("*." + subname)
+		return wc, isubname + "." + subname, nil
 	}
 
 	if shortCircuitFunc != nil {
@@ -449,6 +1001,12 @@ func (tx *btx) _findNCValue(ncv *ncdomain.Value, isubname, subname string, depth
 	return ncv, subname, nil
 }
 
+// Returns the fully qualified form of a name relative to the domain being
+// looked up, as built by _findNCValue (e.g. "a.b." or "").
+func (tx *btx) absName(subname string) string {
+	return dns.Fqdn(subname + tx.basename + "." + tx.rootname)
+}
+
 func (tx *btx) addAnswersUnderNCValueActual(ncv *ncdomain.Value, sn string) (rrs []dns.RR, err error) {
 	rrs, err = ncv.RRs(nil, dns.Fqdn(tx.qname), dns.Fqdn(tx.basename+"."+tx.rootname))
 
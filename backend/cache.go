@@ -0,0 +1,292 @@
+package backend
+
+import "container/list"
+import "github.com/golang/groupcache/lru"
+import "time"
+
+// The caches belonging to a single stream isolation ID. Keeping these
+// separate prevents one stream from learning which names another has looked
+// up.
+type isolationCache struct {
+	id string
+
+	// items are of type *cacheEntry
+	names *lru.Cache
+	// items are of type *negativeCacheEntry
+	negative *lru.Cache
+	// items are of type *parsedCacheEntry
+	parsed *lru.Cache
+
+	lastUsed time.Time
+	elem     *list.Element
+}
+
+// CacheStats describes the current state of the backend's name caches.
+type CacheStats struct {
+	// Number of stream isolation IDs for which caches are currently held.
+	Isolations int
+
+	// Total entries held across all stream isolation IDs.
+	Names         int
+	NegativeNames int
+	ParsedNames   int
+
+	// Lookups answered from the name and negative caches, and lookups which
+	// had to be passed on to namecoind.
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+
+	// Lookups answered with a stale value because namecoind failed.
+	StaleHits uint64
+
+	// Whole stream isolation caches discarded because the limit on their
+	// number was reached, or because they had gone unused for too long.
+	IsolationsEvicted uint64
+	IsolationsExpired uint64
+}
+
+// Returns the caches for a stream isolation ID, marking them as recently
+// used. If create is false and no caches exist, nil is returned. Must be
+// called with cacheMutex held.
+func (b *Backend) isolationCache(streamIsolationID string, create bool) *isolationCache {
+	now := time.Now()
+	b.expireIsolationCaches(now)
+
+	if ic, ok := b.caches[streamIsolationID]; ok {
+		ic.lastUsed = now
+		b.cacheLRU.MoveToFront(ic.elem)
+		return ic
+	}
+
+	if !create {
+		return nil
+	}
+
+	if b.cfg.CacheMaxIsolations > 0 {
+		for len(b.caches) >= b.cfg.CacheMaxIsolations {
+			b.removeIsolationCache(b.cacheLRU.Back().Value.(*isolationCache))
+			b.cacheStats.IsolationsEvicted++
+		}
+	}
+
+	ic := &isolationCache{
+		id:       streamIsolationID,
+		names:    &lru.Cache{MaxEntries: b.cfg.CacheMaxEntries},
+		negative: &lru.Cache{MaxEntries: b.cfg.NegativeCacheMaxEntries},
+		parsed:   &lru.Cache{MaxEntries: b.cfg.CacheMaxEntries},
+		lastUsed: now,
+	}
+	ic.elem = b.cacheLRU.PushFront(ic)
+	b.caches[streamIsolationID] = ic
+
+	return ic
+}
+
+// Discards the caches of any stream isolation ID which has not been used
+// within the idle timeout. The LRU list is ordered by last use, so only its
+// tail needs examining. Must be called with cacheMutex held.
+func (b *Backend) expireIsolationCaches(now time.Time) {
+	if b.cfg.CacheIsolationIdleTimeout <= 0 {
+		return
+	}
+
+	timeout := time.Duration(b.cfg.CacheIsolationIdleTimeout) * time.Second
+	for e := b.cacheLRU.Back(); e != nil; e = b.cacheLRU.Back() {
+		ic := e.Value.(*isolationCache)
+		if now.Sub(ic.lastUsed) <= timeout {
+			break
+		}
+
+		b.removeIsolationCache(ic)
+		b.cacheStats.IsolationsExpired++
+	}
+}
+
+func (b *Backend) removeIsolationCache(ic *isolationCache) {
+	b.cacheLRU.Remove(ic.elem)
+	delete(b.caches, ic.id)
+}
+
+// CacheStats returns statistics about the backend's name caches.
+func (b *Backend) CacheStats() CacheStats {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.expireIsolationCaches(time.Now())
+
+	stats := b.cacheStats
+	stats.Isolations = len(b.caches)
+	for _, ic := range b.caches {
+		stats.Names += ic.names.Len()
+		stats.NegativeNames += ic.negative.Len()
+		stats.ParsedNames += ic.parsed.Len()
+	}
+
+	return stats
+}
+
+// A name value in the cache, along with enough information to decide whether
+// it is still fresh.
+type cacheEntry struct {
+	jsonValue  string
+	height     int64
+	generation uint64
+	added      time.Time
+}
+
+// Returns the cached value of a name, if any, and whether it is still fresh.
+// Values which are no longer fresh are only returned while they may still be
+// served stale; see Config.ServeStale.
+func (b *Backend) resolveNameCache(name, streamIsolationID string) (e *cacheEntry, fresh bool) {
+	generation := b.chainTipGeneration()
+
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	ic := b.isolationCache(streamIsolationID, false)
+	if ic == nil {
+		b.cacheStats.Misses++
+		return nil, false
+	}
+
+	dd, ok := ic.names.Get(name)
+	if !ok {
+		b.cacheStats.Misses++
+		return nil, false
+	}
+
+	e = dd.(*cacheEntry)
+	if !b.cacheEntryFresh(e.generation, e.added, generation) {
+		b.cacheStats.Misses++
+		if time.Since(e.added) < time.Duration(b.cfg.ServeStale)*time.Second {
+			return e, false
+		}
+
+		ic.names.Remove(name)
+		return nil, false
+	}
+
+	b.cacheStats.Hits++
+	return e, true
+}
+
+func (b *Backend) noteStaleHit() {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.cacheStats.StaleHits++
+}
+
+func (b *Backend) cacheEntryFresh(entryGeneration uint64, added time.Time, generation uint64) bool {
+	if entryGeneration != generation {
+		return false
+	}
+
+	if b.cfg.CacheMaxAge > 0 && time.Since(added) > time.Duration(b.cfg.CacheMaxAge)*time.Second {
+		return false
+	}
+
+	return true
+}
+
+func (b *Backend) addNamecoinJSONToCache(name string, jsonValue string, height int64, generation uint64, streamIsolationID string) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.isolationCache(streamIsolationID, true).names.Add(name, &cacheEntry{
+		jsonValue:  jsonValue,
+		height:     height,
+		generation: generation,
+		added:      time.Now(),
+	})
+}
+
+// A name known not to exist.
+type negativeCacheEntry struct {
+	generation uint64
+	added      time.Time
+}
+
+func (b *Backend) resolveNegativeCache(name, streamIsolationID string) bool {
+	generation := b.chainTipGeneration()
+
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	ic := b.isolationCache(streamIsolationID, false)
+	if ic == nil {
+		return false
+	}
+
+	dd, ok := ic.negative.Get(name)
+	if !ok {
+		return false
+	}
+
+	// A new block may have registered the name, so negative entries are
+	// invalidated by chain tip changes just like positive ones.
+	e := dd.(*negativeCacheEntry)
+	if e.generation != generation || time.Since(e.added) > time.Duration(b.cfg.SOAMinTTL)*time.Second {
+		ic.negative.Remove(name)
+		return false
+	}
+
+	b.cacheStats.NegativeHits++
+	return true
+}
+
+func (b *Backend) addNegativeCache(name string, generation uint64, streamIsolationID string) {
+	if b.cfg.NegativeCacheMaxEntries <= 0 {
+		return
+	}
+
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.isolationCache(streamIsolationID, true).negative.Add(name, &negativeCacheEntry{
+		generation: generation,
+		added:      time.Now(),
+	})
+}
+
+// A fully parsed domain, including the results of any imports.
+type parsedCacheEntry struct {
+	d          *domain
+	generation uint64
+	added      time.Time
+}
+
+// Returns the cached parsed domain for a name, if any, and whether it is
+// still fresh. A stale domain is returned so that the caller can revalidate
+// it cheaply instead of reparsing.
+func (b *Backend) resolveParsedCache(name, streamIsolationID string) (d *domain, fresh bool) {
+	generation := b.chainTipGeneration()
+
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	ic := b.isolationCache(streamIsolationID, false)
+	if ic == nil {
+		return nil, false
+	}
+
+	dd, ok := ic.parsed.Get(name)
+	if !ok {
+		return nil, false
+	}
+
+	e := dd.(*parsedCacheEntry)
+	return e.d, b.cacheEntryFresh(e.generation, e.added, generation)
+}
+
+func (b *Backend) addParsedCache(name string, d *domain, generation uint64, streamIsolationID string) {
+	b.cacheMutex.Lock()
+	defer b.cacheMutex.Unlock()
+
+	b.isolationCache(streamIsolationID, true).parsed.Add(name, &parsedCacheEntry{
+		d:          d,
+		generation: generation,
+		added:      time.Now(),
+	})
+}
@@ -0,0 +1,181 @@
+package backend
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+import "github.com/btcsuite/btcd/chaincfg/chainhash"
+
+// Implemented by *namecoin.Client; used to tell reorganizations apart from
+// new blocks.
+type blockHashSource interface {
+	GetBlockHash(height int64) (*chainhash.Hash, error)
+}
+
+// Polls the name source for the chain tip until the backend is closed.
+func (b *Backend) watchChainTip(ts ChainTipSource) {
+	interval := time.Duration(b.cfg.ChainTipPollInterval) * time.Millisecond
+
+	for {
+		err := b.updateChainTip(ts)
+		if err == ErrNoChainTip {
+			return
+		}
+
+		select {
+		case <-b.quit:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (b *Backend) updateChainTip(ts ChainTipSource) error {
+	height, hash, err := ts.ChainTip()
+	if err == ErrNoChainTip {
+		return err
+	}
+	if err != nil {
+		log.Errore(err, "failed to query chain tip")
+		return err
+	}
+
+	b.tipMutex.Lock()
+	prevHeight, prevHash := b.tipHeight, b.tipHash
+	b.tipMutex.Unlock()
+
+	if hash == prevHash {
+		return nil
+	}
+
+	if prevHash != "" {
+		// A new tip at a greater height is usually just a new block, but
+		// could also be a reorganization which replaced the block we last
+		// saw. Either way the cache is invalidated; we only distinguish the
+		// two for logging purposes, where the source lets us.
+		reorg := height <= prevHeight
+		if bh, ok := ts.(blockHashSource); ok && !reorg {
+			oldHash, err := bh.GetBlockHash(prevHeight)
+			reorg = err == nil && oldHash.String() != prevHash
+		}
+
+		if reorg {
+			log.Warnf("chain reorganization: tip %d %s -> %d %s", prevHeight, prevHash, height, hash)
+		} else {
+			log.Debugf("new chain tip: %d %s", height, hash)
+		}
+	}
+
+	b.tipMutex.Lock()
+	b.tipHeight, b.tipHash = height, hash
+	if prevHash != "" {
+		b.tipGeneration++
+	}
+	prevSerial := b.tipSerial
+	if hash != b.serialFileHash {
+		// Unless this is the tip the recorded serial belongs to, as after a
+		// restart without a new block, the zone may have changed.
+		b.tipSerial = nextSerial(b.tipSerial, height)
+	}
+	b.serialFileHash = ""
+	serial := b.tipSerial
+	b.tipMutex.Unlock()
+
+	if b.cfg.SerialFile != "" && serial != prevSerial {
+		log.Errore(writeSerial(b.cfg.SerialFile, serial, hash), "couldn't record SOA serial")
+	}
+
+	if b.cfg.OnChainTipChange != nil {
+		b.cfg.OnChainTipChange(height, hash)
+	}
+
+	return nil
+}
+
+// Returns the current chain tip generation. Cache entries created under any
+// other generation are stale.
+func (b *Backend) chainTipGeneration() uint64 {
+	b.tipMutex.Lock()
+	defer b.tipMutex.Unlock()
+
+	return b.tipGeneration
+}
+
+// The SOA serial is the block height of the chain tip, except that it must
+// increase whenever the zone may have changed. A reorganization to a tip at
+// the same or a lower height therefore still advances it, after which it
+// stays ahead of the height by the number of blocks the chain lost.
+func nextSerial(prevSerial uint32, height int64) uint32 {
+	serial := uint32(height)
+	if prevSerial != 0 && serial <= prevSerial {
+		serial = prevSerial + 1
+	}
+
+	return serial
+}
+
+// Reads the serial recorded by writeSerial, and the hash of the chain tip it
+// was recorded for. A missing file, or an empty filename, yields 0.
+func readSerial(filename string) (serial uint32, hash string, err error) {
+	if filename == "" {
+		return 0, "", nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, "", fmt.Errorf("couldn't parse serial in %s", filename)
+	}
+
+	n, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("couldn't parse serial in %s: %v", filename, err)
+	}
+
+	if len(fields) == 2 {
+		hash = fields[1]
+	}
+
+	return uint32(n), hash, nil
+}
+
+// Records serial, and the hash of the chain tip it belongs to, in filename,
+// replacing it atomically.
+func writeSerial(filename string, serial uint32, hash string) error {
+	err := ioutil.WriteFile(filename+".tmp", []byte(fmt.Sprintf("%d %s\n", serial, hash)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+// SOASerial returns the serial advertised in the zone apex SOA. Until the
+// chain tip has been observed, this is 1.
+func (b *Backend) SOASerial() uint32 {
+	b.tipMutex.Lock()
+	defer b.tipMutex.Unlock()
+
+	if b.tipSerial == 0 {
+		return 1
+	}
+
+	return b.tipSerial
+}
+
+// ChainTip returns the height and hash of the most recently observed chain
+// tip. The hash is empty if the tip has not been observed yet.
+func (b *Backend) ChainTip() (height int64, hash string) {
+	b.tipMutex.Lock()
+	defer b.tipMutex.Unlock()
+
+	return b.tipHeight, b.tipHash
+}
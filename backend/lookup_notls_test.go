@@ -0,0 +1,238 @@
+//go:build no_namecoin_tls
+// +build no_namecoin_tls
+
+package backend_test
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+import "gopkg.in/hlandau/madns.v2/merr"
+import "github.com/namecoin/ncdns/backend"
+import "github.com/namecoin/ncdns/namecoin"
+
+func TestLookupDetail(t *testing.T) {
+	b, err := backend.New(&backend.Config{
+		NameSource: backend.StaticSource{
+			"d/example": `{"ip":"192.0.2.1","map":{
+				"*":{"ip":"192.0.2.2"},
+				"www":{"ip":"192.0.2.3"},
+				"_tcp":{"map":{"_443":{"txt":"x"}}},
+				"sub":{"map":{"*":{"ip":"192.0.2.4"}}},
+				"deleg":{"ns":["ns1.deleg.example.bit."],"map":{"ns1":{"ip":"192.0.2.5"}}},
+				"wild":{"map":{"*":{"ns":["ns1.example.net."]}}}
+			}}`,
+		},
+		SelfIP: "127.127.127.127",
+	})
+	if err != nil {
+		t.Fatalf("couldn't create backend: %v", err)
+	}
+	defer b.Close()
+
+	tests := []struct {
+		qname           string
+		nx              bool
+		rrs             int
+		closestEncloser string
+		wildcard        string
+		delegation      string
+	}{
+		{"example.bit.", false, 1, "example.bit.", "", ""},
+		{"www.example.bit.", false, 1, "www.example.bit.", "", ""},
+		{"foo.example.bit.", false, 1, "example.bit.", "*.example.bit.", ""},
+
+		// The wildcard of the closest encloser matches names several labels
+		// beneath it.
+		{"a.foo.example.bit.", false, 1, "example.bit.", "*.example.bit.", ""},
+
+		// An empty non-terminal exists, so it is NODATA rather than being
+		// matched by the wildcard.
+		{"_tcp.example.bit.", false, 0, "_tcp.example.bit.", "", ""},
+		{"_443._tcp.example.bit.", false, 1, "_443._tcp.example.bit.", "", ""},
+		{"_80._tcp.example.bit.", true, 0, "_tcp.example.bit.", "", ""},
+		{"x.sub.example.bit.", false, 1, "sub.example.bit.", "*.sub.example.bit.", ""},
+		{"x.www.example.bit.", true, 0, "www.example.bit.", "", ""},
+		{"nonexistent.bit.", true, 0, "bit.", "", ""},
+
+		// Names at and beneath a zone cut get a referral with glue, even
+		// where the value has data for them.
+		{"deleg.example.bit.", false, 2, "deleg.example.bit.", "", "deleg.example.bit."},
+		{"ns1.deleg.example.bit.", false, 2, "deleg.example.bit.", "", "deleg.example.bit."},
+		{"www.deleg.example.bit.", false, 2, "deleg.example.bit.", "", "deleg.example.bit."},
+
+		// A wildcard with nameservers delegates the names it matches.
+		{"x.wild.example.bit.", false, 1, "x.wild.example.bit.", "", "x.wild.example.bit."},
+	}
+
+	for _, tst := range tests {
+		res, err := b.LookupDetail(tst.qname, "")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tst.qname, err)
+			continue
+		}
+
+		if res.NXDomain != tst.nx || len(res.RRs) != tst.rrs || res.ClosestEncloser != tst.closestEncloser ||
+			res.Wildcard != tst.wildcard || res.Delegation != tst.delegation {
+			t.Errorf("%s: got NXDomain=%v, %d RRs, closest encloser %q, wildcard %q, delegation %q; expected %v, %d, %q, %q, %q",
+				tst.qname, res.NXDomain, len(res.RRs), res.ClosestEncloser, res.Wildcard, res.Delegation,
+				tst.nx, tst.rrs, tst.closestEncloser, tst.wildcard, tst.delegation)
+		}
+
+		for _, rr := range res.RRs {
+			owner := dns.Fqdn(tst.qname)
+			switch {
+			case tst.delegation == "":
+			case rr.Header().Rrtype == dns.TypeNS:
+				owner = tst.delegation
+			default:
+				owner = "ns1." + tst.delegation
+			}
+
+			if rr.Header().Name != owner {
+				t.Errorf("%s: record has wrong owner name: %v", tst.qname, rr)
+			}
+		}
+	}
+}
+
+// A name source reporting every name as having expired the given number of
+// blocks ago.
+type expiredSource struct {
+	backend.StaticSource
+	blocksAgo int64
+}
+
+func (s expiredSource) NameQueryMetadata(name, streamIsolationID string) (string, *namecoin.NameMetadata, error) {
+	v, err := s.NameQuery(name, streamIsolationID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return v, &namecoin.NameMetadata{
+		Height:    1000,
+		ExpiresIn: -s.blocksAgo,
+		Expired:   true,
+	}, nil
+}
+
+func TestExpiryGracePeriod(t *testing.T) {
+	tests := []struct {
+		blocksAgo int64
+		grace     int
+		nx        bool
+	}{
+		{0, 0, true},
+		{100, 0, true},
+		{100, 200, false},
+		{200, 200, true},
+	}
+
+	for _, tst := range tests {
+		b, err := backend.New(&backend.Config{
+			NameSource: expiredSource{
+				StaticSource: backend.StaticSource{"d/example": `{"ip":"192.0.2.1"}`},
+				blocksAgo:    tst.blocksAgo,
+			},
+			ExpiryGracePeriod: tst.grace,
+			SelfIP:            "127.127.127.127",
+		})
+		if err != nil {
+			t.Fatalf("couldn't create backend: %v", err)
+		}
+
+		res, err := b.LookupDetail("example.bit.", "")
+		_, resolveErr := b.ResolveName("d/example")
+		b.Close()
+		if (resolveErr == merr.ErrNoSuchDomain) != tst.nx || (resolveErr != nil && resolveErr != merr.ErrNoSuchDomain) {
+			t.Errorf("expired %d blocks ago, grace period %d: ResolveName returned %v", tst.blocksAgo, tst.grace, resolveErr)
+		}
+
+		if err != nil {
+			t.Errorf("expired %d blocks ago, grace period %d: unexpected error: %v", tst.blocksAgo, tst.grace, err)
+			continue
+		}
+
+		if res.NXDomain != tst.nx {
+			t.Errorf("expired %d blocks ago, grace period %d: got NXDomain=%v, expected %v",
+				tst.blocksAgo, tst.grace, res.NXDomain, tst.nx)
+		}
+	}
+}
+
+type tipSource struct {
+	backend.StaticSource
+	height int64
+	hash   string
+}
+
+func (s tipSource) ChainTip() (int64, string, error) {
+	return s.height, s.hash, nil
+}
+
+func TestSerialFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ncdns-serial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		recorded string
+		height   int64
+		hash     string
+		serial   uint32
+		file     string
+	}{
+		// The chain was reorganized to a lower height while ncdns wasn't
+		// running; the serial must not go back.
+		{"150 aa\n", 100, "bb", 151, "151 bb\n"},
+		{"150\n", 100, "bb", 151, "151 bb\n"},
+
+		// Restarted at the tip the serial was recorded for.
+		{"151 bb\n", 100, "bb", 151, "151 bb\n"},
+		{"100 bb\n", 100, "bb", 100, "100 bb\n"},
+
+		// A new block arrived meanwhile.
+		{"100 aa\n", 101, "bb", 101, "101 bb\n"},
+	}
+
+	fn := filepath.Join(dir, "soa-serial")
+	for _, tst := range tests {
+		err = ioutil.WriteFile(fn, []byte(tst.recorded), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := backend.New(&backend.Config{
+			NameSource:           tipSource{StaticSource: backend.StaticSource{}, height: tst.height, hash: tst.hash},
+			ChainTipPollInterval: 10,
+			SerialFile:           fn,
+			SelfIP:               "127.127.127.127",
+		})
+		if err != nil {
+			t.Fatalf("couldn't create backend: %v", err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, hash := b.ChainTip()
+			data, err := ioutil.ReadFile(fn)
+			if hash != "" && err == nil && string(data) == tst.file {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("recorded %q, tip %d %s: serial file holds %q, expected %q", tst.recorded, tst.height, tst.hash, data, tst.file)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if serial := b.SOASerial(); serial != tst.serial {
+			t.Errorf("recorded %q, tip %d %s: got serial %d, expected %d", tst.recorded, tst.height, tst.hash, serial, tst.serial)
+		}
+
+		b.Close()
+	}
+}
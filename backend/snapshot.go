@@ -0,0 +1,198 @@
+package backend
+
+import "os"
+import "sync"
+import "time"
+import "github.com/namecoin/ncbtcjson"
+import "github.com/namecoin/ncdns/namecoin"
+import "github.com/namecoin/ncdns/ncdumpzone"
+
+// SnapshotSource is a NameSource serving names from a name snapshot file, as
+// written by "ncdumpzone -format=snapshot". It allows .bit to be served
+// without access to a Namecoin node.
+//
+// The file is reloaded whenever its modification time or size changes. A
+// snapshot is only swapped in once it has been read completely, so queries
+// never see a partially loaded file; if the new file cannot be read, the
+// previous snapshot continues to be served. Replace the file by renaming a
+// complete new file over it.
+//
+// The file is checked for changes every SnapshotCheckInterval until Close is
+// called, whether or not the backend polls for chain tip changes.
+type SnapshotSource struct {
+	path string
+
+	mutex   sync.RWMutex
+	names   StaticSource
+	heights map[string]int64
+	header  ncdumpzone.SnapshotHeader
+	modTime time.Time
+	size    int64
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// SnapshotCheckInterval is how often a SnapshotSource checks whether its file
+// has changed.
+const SnapshotCheckInterval = 5 * time.Second
+
+// NewSnapshotSource loads the snapshot at path, and starts watching it for
+// changes.
+func NewSnapshotSource(path string) (*SnapshotSource, error) {
+	s := &SnapshotSource{
+		path: path,
+		quit: make(chan struct{}),
+	}
+
+	_, err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go s.watch()
+	return s, nil
+}
+
+func (s *SnapshotSource) watch() {
+	ticker := time.NewTicker(SnapshotCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := s.Reload()
+		log.Errore(err, "failed to reload name snapshot; continuing to serve the previous one")
+	}
+}
+
+// Close stops watching the snapshot file for changes.
+func (s *SnapshotSource) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+	})
+
+	return nil
+}
+
+// Reload rereads the snapshot file if it has changed since it was last
+// loaded. It returns true if a new snapshot was loaded.
+func (s *SnapshotSource) Reload() (bool, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.RLock()
+	unchanged := fi.ModTime().Equal(s.modTime) && fi.Size() == s.size
+	s.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	names := StaticSource{}
+	heights := map[string]int64{}
+	hdr, err := ncdumpzone.ReadSnapshot(f, func(n *ncdumpzone.SnapshotName) error {
+		names[n.Name] = n.Value
+		heights[n.Name] = n.Height
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	s.names = names
+	s.heights = heights
+	s.header = *hdr
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+	s.mutex.Unlock()
+
+	log.Infof("loaded name snapshot %s: %d names at height %d", s.path, len(names), hdr.Height)
+	return true, nil
+}
+
+// NameQuery implements NameSource. Names which have expired as of the
+// snapshot's chain tip are reported as nonexistent.
+func (s *SnapshotSource) NameQuery(name, streamIsolationID string) (string, error) {
+	v, md, err := s.NameQueryMetadata(name, streamIsolationID)
+	if err != nil {
+		return "", err
+	}
+
+	if err = md.Err(); err != nil {
+		return "", err
+	}
+
+	return v, nil
+}
+
+// NameQueryMetadata implements NameMetadataSource. Expiry is determined
+// relative to the chain tip recorded in the snapshot.
+func (s *SnapshotSource) NameQueryMetadata(name, streamIsolationID string) (string, *namecoin.NameMetadata, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	v, err := s.names.NameQuery(name, streamIsolationID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return v, s.metadata(name), nil
+}
+
+// Must be called with mutex held.
+func (s *SnapshotSource) metadata(name string) *namecoin.NameMetadata {
+	md := &namecoin.NameMetadata{
+		Height: s.heights[name],
+	}
+
+	// Names written without a height can't be known to have expired.
+	if md.Height != 0 {
+		md.ExpiresIn = md.Height + namecoin.NameExpirationDepth - s.header.Height
+		md.Expired = md.ExpiresIn <= 0
+	}
+
+	return md
+}
+
+// NameScan implements NameScanner.
+func (s *SnapshotSource) NameScan(start string, count uint32) ([]ncbtcjson.NameShowResult, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	results, err := s.names.NameScan(start, count)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		md := s.metadata(results[i].Name)
+		results[i].Height = int32(md.Height)
+		results[i].ExpiresIn = int32(md.ExpiresIn)
+		results[i].Expired = md.Expired
+	}
+
+	return results, nil
+}
+
+// ChainTip implements ChainTipSource, returning the chain tip recorded in the
+// snapshot. When a new snapshot is loaded, the backend notices the new tip the
+// next time it polls, and refetches the names it has cached.
+func (s *SnapshotSource) ChainTip() (height int64, hash string, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.header.Height, s.header.Hash, nil
+}
@@ -0,0 +1,262 @@
+package backend
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "sort"
+import "strings"
+import "github.com/namecoin/ncbtcjson"
+import "github.com/namecoin/ncdns/namecoin"
+import "gopkg.in/hlandau/madns.v2/merr"
+
+// NameSource provides the values of Namecoin names to the backend.
+// *namecoin.Client is the usual implementation.
+type NameSource interface {
+	// NameQuery returns the value of a name (e.g. "d/example"). If the name
+	// does not exist, the error returned must be merr.ErrNoSuchDomain.
+	// Queries made with different stream isolation IDs should not be
+	// linkable to one another by whatever the source talks to.
+	NameQuery(name, streamIsolationID string) (string, error)
+}
+
+// NameMetadataSource is implemented by name sources which can report the
+// metadata of a name, such as the height at which it was last updated and
+// whether it has expired.
+type NameMetadataSource interface {
+	// NameQueryMetadata is like NameQuery, but also returns the name's
+	// metadata. Names which have expired, or whose value couldn't be decoded,
+	// are returned along with metadata saying so, rather than as errors.
+	NameQueryMetadata(name, streamIsolationID string) (string, *namecoin.NameMetadata, error)
+}
+
+// NameScanner is implemented by name sources which can enumerate the names
+// they know about, in the manner of Namecoin Core's name_scan.
+type NameScanner interface {
+	// NameScan returns up to count names, in order, starting with the first
+	// name not less than start.
+	NameScan(start string, count uint32) ([]ncbtcjson.NameShowResult, error)
+}
+
+// ChainTipSource is implemented by name sources which follow a blockchain.
+type ChainTipSource interface {
+	// ChainTip returns the height and block hash of the chain tip that the
+	// source's names currently reflect.
+	ChainTip() (height int64, hash string, err error)
+}
+
+// ErrNoChainTip may be returned by ChainTip to indicate that a source does
+// not follow a blockchain after all.
+var ErrNoChainTip = errors.New("name source does not track a chain tip")
+
+// StaticSource is a NameSource serving a fixed set of names. Map keys are
+// names (e.g. "d/example") and values are their JSON values.
+type StaticSource map[string]string
+
+// NameQuery implements NameSource.
+func (s StaticSource) NameQuery(name, streamIsolationID string) (string, error) {
+	v, ok := s[name]
+	if !ok {
+		return "", merr.ErrNoSuchDomain
+	}
+
+	return v, nil
+}
+
+// NameScan implements NameScanner.
+func (s StaticSource) NameScan(start string, count uint32) ([]ncbtcjson.NameShowResult, error) {
+	names := make([]string, 0, len(s))
+	for k := range s {
+		if k >= start {
+			names = append(names, k)
+		}
+	}
+
+	sort.Strings(names)
+	if uint32(len(names)) > count {
+		names = names[0:count]
+	}
+
+	results := make([]ncbtcjson.NameShowResult, 0, len(names))
+	for _, k := range names {
+		results = append(results, ncbtcjson.NameShowResult{
+			Name:  k,
+			Value: s[k],
+		})
+	}
+
+	return results, nil
+}
+
+// FileSource is a NameSource serving names loaded from a JSON file. The file
+// must contain a single object mapping names to values; each value may be
+// given either as a JSON object or as a string containing JSON.
+//
+//	{
+//	  "d/example": {"ip": "192.0.2.1"},
+//	  "d/other": "{\"ip\": \"192.0.2.2\"}"
+//	}
+type FileSource struct {
+	StaticSource
+}
+
+// NewFileSource loads a FileSource from the file at path.
+func NewFileSource(path string) (*FileSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := parseNameFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSource{StaticSource: names}, nil
+}
+
+func parseNameFile(data []byte) (StaticSource, error) {
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(StaticSource, len(raw))
+	for k, v := range raw {
+		if strings.HasPrefix(strings.TrimSpace(string(v)), `"`) {
+			var s string
+			err = json.Unmarshal(v, &s)
+			if err != nil {
+				return nil, err
+			}
+
+			names[k] = s
+			continue
+		}
+
+		names[k] = string(v)
+	}
+
+	return names, nil
+}
+
+// MultiSource is a NameSource which consults several sources in order. A name
+// is taken from the first source which has it.
+type MultiSource []NameSource
+
+// NameQuery implements NameSource. merr.ErrNoSuchDomain is only returned if
+// every source reports that the name does not exist; otherwise, if no source
+// has the name, the first other error encountered is returned.
+func (ms MultiSource) NameQuery(name, streamIsolationID string) (string, error) {
+	var firstErr error
+
+	for _, s := range ms {
+		v, err := s.NameQuery(name, streamIsolationID)
+		if err == nil {
+			return v, nil
+		}
+
+		if err != merr.ErrNoSuchDomain && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+
+	return "", merr.ErrNoSuchDomain
+}
+
+// NameQueryMetadata implements NameMetadataSource. The metadata is empty if
+// the source the name was taken from can't report any.
+func (ms MultiSource) NameQueryMetadata(name, streamIsolationID string) (string, *namecoin.NameMetadata, error) {
+	var firstErr error
+
+	for _, s := range ms {
+		v, md, err := queryMetadata(s, name, streamIsolationID)
+		if err == nil {
+			return v, md, nil
+		}
+
+		if err != merr.ErrNoSuchDomain && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return "", nil, firstErr
+	}
+
+	return "", nil, merr.ErrNoSuchDomain
+}
+
+// Queries src for a name and its metadata, which is empty if src can't report
+// any.
+func queryMetadata(src NameSource, name, streamIsolationID string) (string, *namecoin.NameMetadata, error) {
+	if ms, ok := src.(NameMetadataSource); ok {
+		return ms.NameQueryMetadata(name, streamIsolationID)
+	}
+
+	v, err := src.NameQuery(name, streamIsolationID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return v, &namecoin.NameMetadata{}, nil
+}
+
+// ChainTip implements ChainTipSource by returning the tip of the first source
+// which follows a chain.
+func (ms MultiSource) ChainTip() (height int64, hash string, err error) {
+	for _, s := range ms {
+		if ts, ok := s.(ChainTipSource); ok {
+			height, hash, err = ts.ChainTip()
+			if err != ErrNoChainTip {
+				return
+			}
+		}
+	}
+
+	return 0, "", ErrNoChainTip
+}
+
+// NameScan implements NameScanner by merging the names of every source. Where
+// several sources have a name, the value from the first is used. Every source
+// must implement NameScanner.
+func (ms MultiSource) NameScan(start string, count uint32) ([]ncbtcjson.NameShowResult, error) {
+	seen := map[string]struct{}{}
+	var results []ncbtcjson.NameShowResult
+
+	for _, s := range ms {
+		scanner, ok := s.(NameScanner)
+		if !ok {
+			return nil, fmt.Errorf("name source %T cannot enumerate names", s)
+		}
+
+		sr, err := scanner.NameScan(start, count)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range sr {
+			if _, ok := seen[r.Name]; ok {
+				continue
+			}
+
+			seen[r.Name] = struct{}{}
+			results = append(results, r)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	if uint32(len(results)) > count {
+		results = results[0:count]
+	}
+
+	return results, nil
+}
@@ -0,0 +1,138 @@
+package backend_test
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "testing"
+import "github.com/namecoin/ncdns/backend"
+import "gopkg.in/hlandau/madns.v2/merr"
+
+type errorSource struct{}
+
+func (errorSource) NameQuery(name, streamIsolationID string) (string, error) {
+	return "", fmt.Errorf("unavailable")
+}
+
+func TestStaticSource(t *testing.T) {
+	s := backend.StaticSource{
+		"d/a": `{"ip":"192.0.2.1"}`,
+		"d/b": `{"ip":"192.0.2.2"}`,
+		"d/c": `{"ip":"192.0.2.3"}`,
+	}
+
+	v, err := s.NameQuery("d/a", "")
+	if err != nil || v != s["d/a"] {
+		t.Errorf("unexpected result for d/a: %q, %v", v, err)
+	}
+
+	_, err = s.NameQuery("d/x", "")
+	if err != merr.ErrNoSuchDomain {
+		t.Errorf("expected ErrNoSuchDomain for d/x, got %v", err)
+	}
+
+	results, err := s.NameScan("d/b", 5)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	if len(results) != 2 || results[0].Name != "d/b" || results[1].Name != "d/c" {
+		t.Errorf("unexpected scan results: %+v", results)
+	}
+
+	results, err = s.NameScan("", 1)
+	if err != nil || len(results) != 1 || results[0].Name != "d/a" {
+		t.Errorf("unexpected limited scan results: %+v, %v", results, err)
+	}
+}
+
+func TestMultiSource(t *testing.T) {
+	first := backend.StaticSource{"d/a": `{"ip":"192.0.2.1"}`}
+	second := backend.StaticSource{
+		"d/a": `{"ip":"192.0.2.100"}`,
+		"d/b": `{"ip":"192.0.2.2"}`,
+	}
+
+	ms := backend.MultiSource{first, second}
+
+	v, err := ms.NameQuery("d/a", "")
+	if err != nil || v != first["d/a"] {
+		t.Errorf("expected first source to take precedence, got %q, %v", v, err)
+	}
+
+	v, err = ms.NameQuery("d/b", "")
+	if err != nil || v != second["d/b"] {
+		t.Errorf("expected fallthrough to second source, got %q, %v", v, err)
+	}
+
+	_, err = ms.NameQuery("d/x", "")
+	if err != merr.ErrNoSuchDomain {
+		t.Errorf("expected ErrNoSuchDomain, got %v", err)
+	}
+
+	ms = backend.MultiSource{errorSource{}, second}
+	_, err = ms.NameQuery("d/x", "")
+	if err == nil || err == merr.ErrNoSuchDomain {
+		t.Errorf("expected the failing source's error, got %v", err)
+	}
+
+	v, err = ms.NameQuery("d/b", "")
+	if err != nil || v != second["d/b"] {
+		t.Errorf("expected a failing source to be skipped, got %q, %v", v, err)
+	}
+
+	_, _, err = ms.ChainTip()
+	if err != backend.ErrNoChainTip {
+		t.Errorf("expected ErrNoChainTip, got %v", err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	f, err := ioutil.TempFile("", "ncdns-names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{"d/a": {"ip": "192.0.2.1"}, "d/b": "{\"ip\":\"192.0.2.2\"}"}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := backend.NewFileSource(f.Name())
+	if err != nil {
+		t.Fatalf("couldn't load file source: %v", err)
+	}
+
+	v, err := fs.NameQuery("d/a", "")
+	if err != nil || v != `{"ip": "192.0.2.1"}` {
+		t.Errorf("unexpected value for object-valued name: %q, %v", v, err)
+	}
+
+	v, err = fs.NameQuery("d/b", "")
+	if err != nil || v != `{"ip":"192.0.2.2"}` {
+		t.Errorf("unexpected value for string-valued name: %q, %v", v, err)
+	}
+}
+
+func TestMultiSourceNameScan(t *testing.T) {
+	ms := backend.MultiSource{
+		backend.StaticSource{"d/a": "1", "d/c": "1"},
+		backend.StaticSource{"d/a": "2", "d/b": "2", "d/d": "2"},
+	}
+
+	results, err := ms.NameScan("d/a", 3)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	if len(results) != 3 || results[0].Name != "d/a" || results[0].Value != "1" ||
+		results[1].Name != "d/b" || results[2].Name != "d/c" {
+		t.Errorf("unexpected scan results: %+v", results)
+	}
+
+	_, err = backend.MultiSource{errorSource{}}.NameScan("", 1)
+	if err == nil {
+		t.Errorf("expected an error scanning a source which cannot enumerate names")
+	}
+}
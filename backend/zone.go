@@ -0,0 +1,90 @@
+package backend
+
+import "fmt"
+import "github.com/miekg/dns"
+import "gopkg.in/hlandau/madns.v2/merr"
+import "github.com/namecoin/ncbtcjson"
+import "github.com/namecoin/ncdns/ncdomain"
+import "github.com/namecoin/ncdns/ncdumpzone"
+
+// Zone returns the complete contents of the zone at apex (e.g. "bit."), as
+// needed for a zone transfer. The SOA is returned separately from the other
+// records. Every name in the anchor's namespace is enumerated, so the name
+// source must implement NameScanner.
+//
+// The records are not signed; DNSSEC signatures are only generated for
+// individual queries. The SOAs synthesized with PerDomainSOA aren't included,
+// as the anchor zone has no zone cut at the domains they belong to. If apex is not the apex of a configured zone, the error
+// returned is merr.ErrNotInZone.
+func (b *Backend) Zone(apex string) (soa *dns.SOA, rrs []dns.RR, err error) {
+	scanner, ok := b.src.(NameScanner)
+	if !ok {
+		return nil, nil, fmt.Errorf("name source cannot enumerate names")
+	}
+
+	tx := &btx{b: b, qname: dns.Fqdn(apex)}
+	tx.subname, tx.basename, tx.rootname, tx.anchor, err = tx.determineDomain()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tx.basename != "" {
+		return nil, nil, merr.ErrNotInZone
+	}
+
+	rootRRs, err := tx.doRootDomain()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	soa = rootRRs[0].(*dns.SOA)
+	rrs = append(rrs, rootRRs[1:]...)
+
+	if len(b.cfg.CanonicalNameservers) == 0 {
+		for _, sub := range []string{"this", "aia"} {
+			mtx := *tx
+			mtx.subname, mtx.basename = sub, "x--nmc"
+			metaRRs, err := mtx.doMetaDomain()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rrs = append(rrs, metaRRs...)
+		}
+	}
+
+	resolve := func(name string) (string, error) {
+		v, _, err := b.queryName(name, "")
+		return v, err
+	}
+
+	err = ncdumpzone.ScanNames(scanner, tx.anchor.Namespace, func(r *ncbtcjson.NameShowResult) error {
+		basename, err := tx.anchor.NamecoinKeyToBasename(r.Name)
+		if err != nil {
+			// Names outside the namespace, or which aren't valid domain
+			// names, aren't part of the zone.
+			return nil
+		}
+
+		if r.ValueError != "" || b.expired(r.Expired, int64(r.ExpiresIn)) {
+			return nil
+		}
+
+		value := ncdomain.ParseValue(r.Name, r.Value, resolve, nil)
+		if value == nil {
+			return nil
+		}
+
+		apex := dns.Fqdn(basename + "." + tx.rootname)
+		nameRRs, err := value.RRsRecursive(nil, apex, apex)
+		log.Debuge(err, "error generating records for ", r.Name)
+
+		rrs = append(rrs, nameRRs...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return soa, rrs, nil
+}
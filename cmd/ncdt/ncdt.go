@@ -7,6 +7,7 @@ import "fmt"
 import "os"
 import "strconv"
 import "io/ioutil"
+import "time"
 import "github.com/btcsuite/btcd/rpcclient"
 import "github.com/namecoin/ncdns/util"
 
@@ -14,6 +15,8 @@ var rpchost = flag.String("rpchost", "", "Namecoin RPC host:port")
 var rpcuser = flag.String("rpcuser", "", "Namecoin RPC username")
 var rpcpass = flag.String("rpcpass", "", "Namecoin RPC password")
 var rpccookiepath = flag.String("rpccookiepath", "", "Namecoin RPC cookie path (used if password is unspecified)")
+var atHeight = flag.Int64("height", -1, "Resolve as of this block height, using name_history")
+var atTime = flag.String("time", "", "Resolve as of this time (RFC 3339, e.g. 2020-01-02T15:04:05Z), using name_history")
 var conn *namecoin.Client
 
 func usage() {
@@ -24,6 +27,10 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "  -rpcuser=username      Namecoin RPC username        }\n")
 	fmt.Fprintf(os.Stderr, "  -rpcpass=password      Namecoin RPC password        }\n")
 	fmt.Fprintf(os.Stderr, "  -rpccookiepath=path    Namecoin RPC cookie path     }\n")
+	fmt.Fprintf(os.Stderr, "  -height=N              Resolve as of block height N; @ retrieves the value at that\n")
+	fmt.Fprintf(os.Stderr, "                         height, and unspecified imports are also retrieved as of N\n")
+	fmt.Fprintf(os.Stderr, "                         (requires namecoind -namehistory)\n")
+	fmt.Fprintf(os.Stderr, "  -time=time             Like -height, for the last block at or before the given RFC 3339 time\n")
 	os.Exit(2)
 }
 
@@ -44,7 +51,10 @@ func translateValue(k, v string) (string, error) {
 
 		f = os.NewFile(uintptr(n), "-")
 	} else if len(v) == 1 {
-		return conn.NameQuery(k, "")
+		if *atHeight >= 0 {
+			return conn.NameQueryAt(k, *atHeight, "")
+		}
+		return queryName(k)
 	} else {
 		f, err = os.Open(v)
 	}
@@ -63,6 +73,26 @@ func translateValue(k, v string) (string, error) {
 	return string(contents), nil
 }
 
+// Retrieves a name via RPC, reporting its metadata on stderr. Expired names
+// are still returned, with a warning, so that their values can be examined.
+func queryName(k string) (string, error) {
+	v, md, err := conn.NameQueryMetadata(k, "")
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: last updated at height %d, expires in %d blocks\n", k, md.Height, md.ExpiresIn)
+	if md.Expired {
+		fmt.Fprintf(os.Stderr, "Warning: %s has expired\n", k)
+	}
+
+	if md.ValueError != "" {
+		return "", fmt.Errorf("%s: value error: %s", k, md.ValueError)
+	}
+
+	return v, nil
+}
+
 func main() {
 	flag.CommandLine.Usage = usage
 	flag.Parse()
@@ -95,6 +125,24 @@ func main() {
 	}
 	defer conn.Shutdown()
 
+	if *atTime != "" {
+		t, err := time.Parse(time.RFC3339, *atTime)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid time: %v\n", err)
+			os.Exit(1)
+		}
+
+		*atHeight, err = conn.HeightAt(t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't determine block height: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *atHeight >= 0 {
+		fmt.Fprintf(os.Stderr, "Resolving as of block %d\n", *atHeight)
+	}
+
 	for i := 0; i+1 < len(args); i += 2 {
 		k := args[i]
 		v := args[i+1]
@@ -116,20 +164,39 @@ func main() {
 		names[k] = v
 	}
 
-	value := ncdomain.ParseValue(primaryK, primaryV, func(k string) (string, error) {
-		v, ok := names[k]
-		if !ok {
-			return "", fmt.Errorf("reference to unknown name")
-		}
-
-		return v, nil
-	}, func(err error, isWarning bool) {
+	errFunc := func(err error, isWarning bool) {
 		if isWarning {
 			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 		} else {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		}
-	})
+	}
+
+	var value *ncdomain.Value
+	if *atHeight >= 0 {
+		// Names given on the command line take precedence; any others
+		// referenced are retrieved as of the same height.
+		value, err = ncdomain.ParseValueAt(primaryK, *atHeight, func(k string, height int64) (string, error) {
+			if v, ok := names[k]; ok {
+				return v, nil
+			}
+
+			return conn.NameQueryAt(k, height, "")
+		}, errFunc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		value = ncdomain.ParseValue(primaryK, primaryV, func(k string) (string, error) {
+			v, ok := names[k]
+			if !ok {
+				return "", fmt.Errorf("reference to unknown name")
+			}
+
+			return v, nil
+		}, errFunc)
+	}
 
 	suffix, err := util.NamecoinKeyToBasename(primaryK)
 	if err != nil {
@@ -10,6 +10,7 @@ import (
 
 	"github.com/namecoin/ncdns/namecoin"
 	"github.com/namecoin/ncdns/ncdumpzone"
+	"github.com/namecoin/ncdns/util"
 )
 
 var log, _ = xlog.New("ncdumpzone-main")
@@ -27,7 +28,12 @@ var (
 	formatFlag = cflag.String(flagGroup, "format", "zonefile", "Output "+
 		"format.  \"zonefile\" = DNS zone file.  "+
 		"\"firefox-override\" = Firefox cert_override.txt format.  "+
-		"\"url-list\" = URL list.")
+		"\"url-list\" = URL list.  "+
+		"\"snapshot\" = Name snapshot, which ncdns can serve without "+
+		"Namecoin Core.")
+	anchorsFlag = cflag.String(flagGroup, "anchors", "bit",
+		"Comma-separated list of suffixes to dump names under, each "+
+			"optionally followed by =namespace (default d/).")
 )
 
 var conn *namecoin.Client
@@ -42,6 +48,11 @@ func main() {
 		log.Fatalf("Couldn't parse configuration: %s", err)
 	}
 
+	anchors, err := util.ParseAnchors(anchorsFlag.Value())
+	if err != nil {
+		log.Fatalf("Couldn't parse anchors: %s", err)
+	}
+
 	// Connect to local namecoin core RPC server using HTTP POST mode.
 	connCfg := &rpcclient.ConnConfig{
 		Host:         rpchostFlag.Value(),
@@ -60,7 +71,7 @@ func main() {
 	}
 	defer conn.Shutdown()
 
-	err = ncdumpzone.Dump(conn, os.Stdout, formatFlag.Value())
+	err = ncdumpzone.DumpAnchors(conn, os.Stdout, formatFlag.Value(), anchors)
 	if err != nil {
 		log.Fatalf("Couldn't dump zone: %s", err)
 	}
@@ -1,17 +1,34 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/hlandau/dexlogconfig"
+	"github.com/hlandau/xlog"
 	"github.com/namecoin/ncdns/server"
 	"gopkg.in/hlandau/easyconfig.v1"
+	"gopkg.in/hlandau/easyconfig.v1/adaptconf"
 	"gopkg.in/hlandau/service.v2"
 )
 
+var log, _ = xlog.New("ncdns.main")
+
 func main() {
 	cfg := server.Config{}
 
+	// "ncdns resolverconf [unbound|bind|knot|dnsmasq]" prints configuration
+	// for a recursive resolver instead of running the daemon. The usual
+	// options, such as -conf, may follow the subcommand.
+	resolverConf := len(os.Args) > 1 && os.Args[1] == "resolverconf"
+	if resolverConf {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	config := easyconfig.Configurator{
 		ProgramName: "ncdns",
 	}
@@ -21,13 +38,71 @@ func main() {
 	// We use the configPath to resolve paths relative to the config file.
 	cfg.ConfigDir = filepath.Dir(config.ConfigFilePath())
 
+	if resolverConf {
+		format := "unbound"
+		if flag.NArg() > 0 {
+			format = flag.Arg(0)
+		}
+
+		err := server.WriteResolverConfig(os.Stdout, &cfg, format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ncdns: %v\n", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	service.Main(&service.Info{
 		Description:   "Namecoin to DNS Daemon",
 		DefaultChroot: service.EmptyChrootPath,
 		NewFunc: func() (service.Runnable, error) {
-			return server.New(&cfg)
+			// cfg stays bound to the configuration file, and is
+			// overwritten when it is reread, so the server is given a
+			// copy.
+			runCfg := cfg
+			s, err := server.New(&runCfg)
+			if err != nil {
+				return nil, err
+			}
+
+			go reloadOnSIGHUP(s, &cfg, &config)
+			return s, nil
 		},
 	})
 }
 
+// Rereads the configuration file and reloads the server whenever SIGHUP is
+// received. cfg is the target to which easyconfig writes the options; it is
+// first reset to the defaults, so that options removed from the file revert
+// to them, and options given on the command line are then applied again, so
+// that they still take precedence. If the file can't be parsed or the new
+// configuration is invalid, the server continues with its previous
+// configuration.
+func reloadOnSIGHUP(s *server.Server, cfg *server.Config, config *easyconfig.Configurator) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		log.Info("SIGHUP received; reloading configuration")
+
+		*cfg = server.DefaultConfig()
+		err := adaptconf.LoadPath(config.ConfigFilePath())
+		if err != nil {
+			log.Errore(err, "couldn't read configuration file; continuing with the previous configuration")
+			continue
+		}
+
+		flag.Visit(func(f *flag.Flag) {
+			log.Errore(flag.Set(f.Name, f.Value.String()), "couldn't reapply command line option ", f.Name)
+		})
+
+		newCfg := *cfg
+		newCfg.ConfigDir = filepath.Dir(config.ConfigFilePath())
+
+		// Reload validates the configuration and logs its own errors.
+		s.Reload(&newCfg)
+	}
+}
+
 // © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
@@ -0,0 +1,146 @@
+package namecoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"gopkg.in/hlandau/madns.v2/merr"
+
+	"github.com/namecoin/ncbtcjson"
+)
+
+// NameHistory returns every value a name has had, oldest first, using
+// Namecoin Core's name_history RPC. This requires namecoind to have been
+// started with -namehistory. If the name has never existed, the error
+// returned will be merr.ErrNoSuchDomain.
+func (c *Client) NameHistory(name string, streamIsolationID string) ([]ncbtcjson.NameShowResult, error) {
+	params := []interface{}{name}
+	if streamIsolationID != "" {
+		params = append(params, &ncbtcjson.NameShowOptions{StreamID: streamIsolationID})
+	}
+
+	var rawParams []json.RawMessage
+	for _, p := range params {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+
+		rawParams = append(rawParams, b)
+	}
+
+	res, err := c.RawRequest("name_history", rawParams)
+	if err != nil {
+		if jerr, ok := err.(*btcjson.RPCError); ok {
+			if jerr.Code == btcjson.ErrRPCWallet {
+				// As with name_show, ErrRPCWallet indicates that
+				// the name does not exist.
+				return nil, merr.ErrNoSuchDomain
+			}
+		}
+
+		return nil, err
+	}
+
+	var history []ncbtcjson.NameShowResult
+	err = json.Unmarshal(res, &history)
+	if err != nil {
+		return nil, err
+	}
+
+	// name_history returns the oldest value first, but don't rely on it.
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Height < history[j].Height
+	})
+
+	return history, nil
+}
+
+// NameQueryAt returns the value a name had as of the block at the given
+// height: the value set by its most recent update at or before that height.
+// If the name did not exist at that height, or had expired, the error
+// returned will be merr.ErrNoSuchDomain. Like NameHistory, this requires
+// namecoind to have been started with -namehistory.
+func (c *Client) NameQueryAt(name string, height int64, streamIsolationID string) (string, error) {
+	history, err := c.NameHistory(name, streamIsolationID)
+	if err != nil {
+		return "", err
+	}
+
+	return valueAt(history, height)
+}
+
+func valueAt(history []ncbtcjson.NameShowResult, height int64) (string, error) {
+	var current *ncbtcjson.NameShowResult
+	for i := range history {
+		if int64(history[i].Height) > height {
+			break
+		}
+
+		current = &history[i]
+	}
+
+	if current == nil || height-int64(current.Height) >= NameExpirationDepth {
+		return "", merr.ErrNoSuchDomain
+	}
+
+	if current.ValueError != "" {
+		return "", fmt.Errorf("couldn't decode value: %s", current.ValueError)
+	}
+
+	return current.Value, nil
+}
+
+// HeightAt returns the height of the last block in the best chain with a
+// timestamp no later than t. Block timestamps are not strictly increasing, so
+// near t the result may be off by a block or two.
+func (c *Client) HeightAt(t time.Time) (int64, error) {
+	tip, err := c.GetBlockCount()
+	if err != nil {
+		return 0, err
+	}
+
+	blockTime := func(height int64) (time.Time, error) {
+		hash, err := c.GetBlockHash(height)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		hdr, err := c.GetBlockHeader(hash)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return hdr.Timestamp, nil
+	}
+
+	genesis, err := blockTime(0)
+	if err != nil {
+		return 0, err
+	}
+
+	if t.Before(genesis) {
+		return 0, fmt.Errorf("%s is before the genesis block", t.Format(time.RFC3339))
+	}
+
+	// Find the last block not after t.
+	lo, hi := int64(0), tip
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		bt, err := blockTime(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if bt.After(t) {
+			hi = mid - 1
+		} else {
+			lo = mid
+		}
+	}
+
+	return lo, nil
+}
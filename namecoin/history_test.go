@@ -0,0 +1,62 @@
+package namecoin
+
+import (
+	"testing"
+
+	"github.com/namecoin/ncbtcjson"
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+func TestValueAt(t *testing.T) {
+	history := []ncbtcjson.NameShowResult{
+		{Height: 100, Value: "a"},
+		{Height: 200, Value: "b"},
+		{Height: 300, ValueError: "invalid UTF-8"},
+		{Height: 400, Value: "d"},
+	}
+
+	tests := []struct {
+		history  []ncbtcjson.NameShowResult
+		height   int64
+		value    string
+		nx       bool
+		valueErr bool
+	}{
+		// Before the name was registered.
+		{history, 99, "", true, false},
+		{nil, 100, "", true, false},
+
+		{history, 100, "a", false, false},
+		{history, 199, "a", false, false},
+		{history, 200, "b", false, false},
+
+		// An undecodable value is an error, but only while it is current.
+		{history, 300, "", false, true},
+		{history, 399, "", false, true},
+		{history, 400, "d", false, false},
+
+		// A name expires NameExpirationDepth blocks after its last update.
+		{history, 400 + NameExpirationDepth - 1, "d", false, false},
+		{history, 400 + NameExpirationDepth, "", true, false},
+		{history[:3], 300 + NameExpirationDepth - 1, "", false, true},
+		{history[:3], 300 + NameExpirationDepth, "", true, false},
+	}
+
+	for _, tst := range tests {
+		v, err := valueAt(tst.history, tst.height)
+		switch {
+		case tst.nx:
+			if err != merr.ErrNoSuchDomain {
+				t.Errorf("height %d: expected ErrNoSuchDomain, got %q, %v", tst.height, v, err)
+			}
+		case tst.valueErr:
+			if err == nil || err == merr.ErrNoSuchDomain {
+				t.Errorf("height %d: expected a value error, got %q, %v", tst.height, v, err)
+			}
+		default:
+			if err != nil || v != tst.value {
+				t.Errorf("height %d: got %q, %v; expected %q", tst.height, v, err, tst.value)
+			}
+		}
+	}
+}
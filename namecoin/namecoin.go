@@ -1,6 +1,8 @@
 package namecoin
 
 import (
+	"fmt"
+
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/rpcclient"
 	"gopkg.in/hlandau/madns.v2/merr"
@@ -24,26 +26,105 @@ func New(config *rpcclient.ConnConfig, ntfnHandlers *rpcclient.NotificationHandl
 	return &Client{ncClient}, nil
 }
 
-// NameQuery returns the value of a name.  If the name doesn't exist, the error
-// returned will be merr.ErrNoSuchDomain.
+// NameExpirationDepth is the number of blocks after its most recent update
+// at which a Namecoin name expires.
+const NameExpirationDepth = 36000
+
+// NameMetadata describes the state of a name, besides its value.
+type NameMetadata struct {
+	// Height of the block containing the name's most recent update, or 0 if
+	// it is not known.
+	Height int64
+
+	// Number of blocks until the name expires. Zero or negative once it has
+	// expired. Only meaningful if Height is known.
+	ExpiresIn int64
+	Expired   bool
+
+	// Set if the value could not be decoded, in which case the value is
+	// empty.
+	ValueError string
+}
+
+// Err returns the error which NameQuery reports for a name with this
+// metadata: merr.ErrNoSuchDomain if the name has expired, or an error
+// describing its value error, if any.
+func (md *NameMetadata) Err() error {
+	if md.Expired {
+		return merr.ErrNoSuchDomain
+	}
+
+	if md.ValueError != "" {
+		return fmt.Errorf("couldn't decode value: %s", md.ValueError)
+	}
+
+	return nil
+}
+
+// NameQuery returns the value of a name.  If the name doesn't exist or has
+// expired, the error returned will be merr.ErrNoSuchDomain.
 func (c *Client) NameQuery(name string, streamIsolationID string) (string, error) {
+	value, md, err := c.NameQueryMetadata(name, streamIsolationID)
+	if err != nil {
+		return "", err
+	}
+
+	if err = md.Err(); err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// NameQueryMetadata is like NameQuery, but also returns the name's metadata.
+// Names which have expired or whose value couldn't be decoded are returned
+// rather than treated as errors, so that the caller can decide what to do
+// with them.
+func (c *Client) NameQueryMetadata(name string, streamIsolationID string) (string, *NameMetadata, error) {
 	nameData, err := c.NameShow(name, &ncbtcjson.NameShowOptions{StreamID: streamIsolationID})
 	if err != nil {
 		if jerr, ok := err.(*btcjson.RPCError); ok {
 			if jerr.Code == btcjson.ErrRPCWallet {
 				// ErrRPCWallet from name_show indicates that
 				// the name does not exist.
-				return "", merr.ErrNoSuchDomain
+				return "", nil, merr.ErrNoSuchDomain
 			}
 		}
 
 		// Some error besides NXDOMAIN happened; pass that error
 		// through unaltered.
-		return "", err
+		return "", nil, err
+	}
+
+	md := &NameMetadata{
+		Height:     int64(nameData.Height),
+		ExpiresIn:  int64(nameData.ExpiresIn),
+		Expired:    nameData.Expired,
+		ValueError: nameData.ValueError,
 	}
 
-	// TODO: check the "value_error" field for errors and report those to the caller.
+	value := nameData.Value
+	if md.ValueError != "" {
+		value = ""
+	}
 
 	// We got the name data.  Return the value.
-	return nameData.Value, nil
+	return value, md, nil
+}
+
+// ChainTip returns the height and block hash of the current best chain tip.
+// Callers can compare the hash between calls to detect both new blocks and
+// chain reorganizations.
+func (c *Client) ChainTip() (int64, string, error) {
+	height, err := c.GetBlockCount()
+	if err != nil {
+		return 0, "", err
+	}
+
+	hash, err := c.GetBlockHash(height)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return height, hash.String(), nil
 }
@@ -208,8 +208,10 @@ func (v *Value) appendTXTs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, e
 }
 
 func (v *Value) appendDSs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
+	// RRs rewrites the owner names of the records it returns, so append
+	// copies to leave the Value itself untouched.
 	for _, ds := range v.DS {
-		out = append(out, ds)
+		out = append(out, dns.Copy(ds))
 	}
 
 	return out, nil
@@ -217,7 +219,7 @@ func (v *Value) appendDSs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, er
 
 func (v *Value) appendMXs(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
 	for _, mx := range v.MX {
-		out = append(out, mx)
+		out = append(out, dns.Copy(mx))
 	}
 
 	return out, nil
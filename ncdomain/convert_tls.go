@@ -24,7 +24,7 @@ type Value struct {
 
 func (v *Value) appendTLSA(out []dns.RR, suffix, apexSuffix string) ([]dns.RR, error) {
 	for _, tlsa := range v.TLSA {
-		out = append(out, tlsa)
+		out = append(out, dns.Copy(tlsa))
 	}
 
 	for _, cert := range v.TLSAGenerated {
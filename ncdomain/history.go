@@ -0,0 +1,25 @@
+package ncdomain
+
+// HistoricalResolveFunc returns the value a name (e.g. "d/example") had as of
+// the block at the given height, or an error if it didn't exist then.
+// (*namecoin.Client).NameQueryAt provides this using Namecoin Core's
+// name_history.
+type HistoricalResolveFunc func(name string, height int64) (string, error)
+
+// ParseValueAt is like ParseValue, but parses the value the name had as of the
+// block at the given height. The values of domains referenced by "import" and
+// "delegate" statements are likewise taken as of that height, so that the
+// result is what the name resolved to at the time.
+//
+// An error is returned if the name's value at that height couldn't be
+// obtained. Otherwise the result is as for ParseValue.
+func ParseValueAt(name string, height int64, resolve HistoricalResolveFunc, errFunc ErrorFunc) (*Value, error) {
+	jsonValue, err := resolve(name, height)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseValue(name, jsonValue, func(name string) (string, error) {
+		return resolve(name, height)
+	}, errFunc), nil
+}
@@ -0,0 +1,68 @@
+package ncdomain_test
+
+import "fmt"
+import "net"
+import "testing"
+import "github.com/namecoin/ncdns/ncdomain"
+
+func TestParseValueAt(t *testing.T) {
+	// Each name's values, keyed by the height at which they were set.
+	history := map[string]map[int64]string{
+		"d/example": {
+			100: `{"ip":"192.0.2.1","import":"d/imported"}`,
+			300: `{"ip":"192.0.2.3","import":"d/imported"}`,
+		},
+		"d/imported": {
+			150: `{"ip6":"2001:db8::1"}`,
+			250: `{"ip6":"2001:db8::2"}`,
+		},
+	}
+
+	resolve := func(name string, height int64) (string, error) {
+		var value string
+		var setAt int64 = -1
+		for h, v := range history[name] {
+			if h <= height && h > setAt {
+				value, setAt = v, h
+			}
+		}
+
+		if setAt < 0 {
+			return "", fmt.Errorf("%s did not exist at height %d", name, height)
+		}
+
+		return value, nil
+	}
+
+	tests := []struct {
+		height int64
+		ip     string
+		ip6    string
+	}{
+		{120, "192.0.2.1", ""},
+		{200, "192.0.2.1", "2001:db8::1"},
+		{260, "192.0.2.1", "2001:db8::2"},
+		{400, "192.0.2.3", "2001:db8::2"},
+	}
+
+	for _, tst := range tests {
+		v, err := ncdomain.ParseValueAt("d/example", tst.height, resolve, nil)
+		if err != nil {
+			t.Errorf("height %d: unexpected error: %v", tst.height, err)
+			continue
+		}
+
+		if len(v.IP) != 1 || !v.IP[0].Equal(net.ParseIP(tst.ip)) {
+			t.Errorf("height %d: got IPv4 addresses %v, expected %s", tst.height, v.IP, tst.ip)
+		}
+
+		if tst.ip6 == "" && len(v.IP6) != 0 || tst.ip6 != "" && (len(v.IP6) != 1 || !v.IP6[0].Equal(net.ParseIP(tst.ip6))) {
+			t.Errorf("height %d: got IPv6 addresses %v, expected %q", tst.height, v.IP6, tst.ip6)
+		}
+	}
+
+	_, err := ncdomain.ParseValueAt("d/example", 50, resolve, nil)
+	if err == nil {
+		t.Errorf("expected an error for a height before the name existed")
+	}
+}
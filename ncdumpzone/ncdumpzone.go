@@ -3,7 +3,6 @@ package ncdumpzone
 import (
 	"fmt"
 	"io"
-	"strings"
 
 	"github.com/hlandau/xlog"
 	"github.com/miekg/dns"
@@ -42,18 +41,46 @@ func dumpRR(rr dns.RR, dest io.Writer, format string) error {
 }
 
 func dumpName(item *ncbtcjson.NameShowResult, conn *namecoin.Client,
-	dest io.Writer, format string) error {
+	dest io.Writer, format string, anchors []util.Anchor) error {
 	// The order in which name_scan returns results is seemingly rather
-	// random, so we can't stop when we see a non-d/ name, so just skip it.
-	if !strings.HasPrefix(item.Name, "d/") {
+	// random, so we can't stop when we see a name outside the anchors'
+	// namespaces, so just skip it.
+	var matched []*util.Anchor
+	for i := range anchors {
+		_, err := anchors[i].NamecoinKeyToBasename(item.Name)
+		if err == nil {
+			matched = append(matched, &anchors[i])
+		}
+	}
+
+	if len(matched) == 0 {
 		return nil
 	}
 
-	suffix, err := util.NamecoinKeyToBasename(item.Name)
-	if err != nil {
+	if item.ValueError != "" {
+		log.Warnf("skipping %s: couldn't decode its value: %s", item.Name, item.ValueError)
 		return nil
 	}
 
+	// Snapshots include expired names, along with the height from which their
+	// expiry can be determined, so that the server can apply a grace period.
+	if format == "snapshot" {
+		return writeSnapshotLine(dest, &SnapshotName{
+			Name:   item.Name,
+			Value:  item.Value,
+			Height: int64(item.Height),
+		})
+	}
+
+	if item.Expired {
+		return nil
+	}
+
+	if format == "zonefile" {
+		fmt.Fprintf(dest, "; %s: last updated at height %d, expires in %d blocks\n",
+			item.Name, item.Height, item.ExpiresIn)
+	}
+
 	getNameFunc := func(k string) (string, error) {
 		return conn.NameQuery(k, "")
 	}
@@ -68,13 +95,16 @@ func dumpName(item *ncbtcjson.NameShowResult, conn *namecoin.Client,
 		return nil
 	}
 
-	rrs, err := value.RRsRecursive(nil, suffix+".bit.", "bit.")
-	log.Warne(err, "error generating RRs")
+	for _, a := range matched {
+		basename, _ := a.NamecoinKeyToBasename(item.Name)
+		rrs, err := value.RRsRecursive(nil, basename+"."+a.Suffix+".", a.Suffix+".")
+		log.Warne(err, "error generating RRs")
 
-	for _, rr := range rrs {
-		err = dumpRR(rr, dest, format)
-		if err != nil {
-			return err
+		for _, rr := range rrs {
+			err = dumpRR(rr, dest, format)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -84,12 +114,69 @@ func dumpName(item *ncbtcjson.NameShowResult, conn *namecoin.Client,
 // Dump extracts all domain names from conn, formats them according to the
 // specified format, and writes the result to dest.
 func Dump(conn *namecoin.Client, dest io.Writer, format string) error {
+	return DumpAnchors(conn, dest, format, util.DefaultAnchors)
+}
+
+// DumpAnchors is like Dump, but dumps the names in each anchor's namespace
+// under that anchor's suffix rather than under .bit. In the snapshot format,
+// every name in any of the namespaces is written once.
+//
+// Names which have expired, or whose value couldn't be decoded, are skipped,
+// except that snapshots include expired names. In the zonefile format, the
+// records of each name are preceded by a comment giving its height and
+// expiry.
+func DumpAnchors(conn *namecoin.Client, dest io.Writer, format string, anchors []util.Anchor) error {
 	if format != "zonefile" && format != "firefox-override" &&
-		format != "url-list" {
+		format != "url-list" && format != "snapshot" {
 		return fmt.Errorf("Invalid \"format\" argument: %s", format)
 	}
 
-	currentName := "d/"
+	if format == "snapshot" {
+		// Names updated by blocks arriving during the scan may or may not
+		// be reflected; the tip recorded is the one the scan started at.
+		height, hash, err := conn.ChainTip()
+		if err != nil {
+			return fmt.Errorf("chain tip: %s", err)
+		}
+
+		err = writeSnapshotLine(dest, &SnapshotHeader{
+			Height: height,
+			Hash:   hash,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(anchors) == 0 {
+		anchors = util.DefaultAnchors
+	}
+
+	// Names are scanned in order, so scanning from the first namespace covers
+	// all of the others too.
+	currentName := anchors[0].Namespace
+	for _, a := range anchors {
+		if a.Namespace < currentName {
+			currentName = a.Namespace
+		}
+	}
+
+	return ScanNames(conn, currentName, func(r *ncbtcjson.NameShowResult) error {
+		return dumpName(r, conn, dest, format, anchors)
+	})
+}
+
+// NameScanner is implemented by *namecoin.Client and by other sources which
+// can enumerate names in the manner of name_scan.
+type NameScanner interface {
+	NameScan(start string, count uint32) ([]ncbtcjson.NameShowResult, error)
+}
+
+// ScanNames calls nameFunc for every name from start onwards, in the order
+// returned by name_scan, until there are no more names or nameFunc returns an
+// error.
+func ScanNames(conn NameScanner, start string, nameFunc func(r *ncbtcjson.NameShowResult) error) error {
+	currentName := start
 	continuing := 0
 	perCall := defaultPerCall
 
@@ -141,7 +228,7 @@ func Dump(conn *namecoin.Client, dest io.Writer, format string) error {
 		for i := range results {
 			r := &results[i]
 
-			err = dumpName(r, conn, dest, format)
+			err = nameFunc(r)
 			if err != nil {
 				return err
 			}
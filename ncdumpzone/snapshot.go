@@ -0,0 +1,71 @@
+package ncdumpzone
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A name snapshot is a file of newline-separated JSON objects. The first is a
+// SnapshotHeader describing the chain tip the snapshot was taken at; every
+// following line is a SnapshotName.
+//
+//	{"height":500000,"hash":"..."}
+//	{"name":"d/example","value":"{\"ip\":\"192.0.2.1\"}","height":499000}
+
+// SnapshotHeader is the first line of a name snapshot.
+type SnapshotHeader struct {
+	// Height and hash of the chain tip when the snapshot was started.
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// SnapshotName is a single name in a name snapshot.
+type SnapshotName struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+
+	// Height of the block containing the name's most recent update.
+	Height int64 `json:"height,omitempty"`
+}
+
+// ReadSnapshot reads a name snapshot from r, calling nameFunc for every name
+// in it. Reading stops at the first error returned by nameFunc.
+func ReadSnapshot(r io.Reader, nameFunc func(n *SnapshotName) error) (*SnapshotHeader, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	hdr := &SnapshotHeader{}
+	err := dec.Decode(hdr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read snapshot header: %v", err)
+	}
+
+	for {
+		n := &SnapshotName{}
+		err = dec.Decode(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read snapshot: %v", err)
+		}
+
+		err = nameFunc(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hdr, nil
+}
+
+func writeSnapshotLine(dest io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(dest, "%s\n", b)
+	return err
+}
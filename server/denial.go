@@ -0,0 +1,313 @@
+package server
+
+import (
+	"crypto"
+	"encoding/base32"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+	"github.com/namecoin/ncdns/util"
+)
+
+// Adds NSEC3 records (RFC 5155) proving the nonexistence of names and
+// records to the negative responses of a signed zone, so that they can be
+// validated. The records are "white lies" (RFC 7129 section 5.1): each one
+// covers only the hash of the name being denied, since the zone is far too
+// large to hash every name in advance.
+type denialHandler struct {
+	st                *state
+	next              dns.Handler
+	streamIsolationID string
+}
+
+// NSEC3 parameters. Per RFC 9276, no extra iterations or salt are used.
+const nsec3Iterations = 0
+const nsec3Salt = ""
+
+// Signatures generated by ncdns itself are valid from this long before they
+// are generated, to allow for clock skew, until this long after.
+const sigInception = time.Hour
+const sigExpiration = 24 * time.Hour
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func (h *denialHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h.next.ServeDNS(&hookWriter{ResponseWriter: w, req: r, hook: h.addDenial}, r)
+}
+
+// Adds signed NSEC3 records to m, the response to r, if it is a negative
+// response (or an answer synthesized from a wildcard, or an unsigned
+// referral) for a name in one of our zones. Returns true if any records were
+// added.
+func (h *denialHandler) addDenial(r, m *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil || !opt.Do() || len(r.Question) != 1 {
+		return false
+	}
+
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return false
+	}
+
+	var soa *dns.SOA
+	for _, rr := range m.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC, *dns.NSEC3:
+			// The engine has already provided a proof.
+			return false
+		case *dns.SOA:
+			soa = rr
+		}
+	}
+
+	qname := dns.CanonicalName(r.Question[0].Name)
+	_, _, rootname, _, err := util.SplitDomainByFloatingAnchors(qname, h.st.cfg.anchors)
+	if err != nil || rootname == "" {
+		return false
+	}
+
+	res, err := h.st.backend.LookupDetail(qname, h.streamIsolationID)
+	if err != nil {
+		log.Debuge(err, "couldn't look up ", qname, " to deny its existence")
+		return false
+	}
+
+	match, cover := denialNames(res, qname, m)
+	if match == nil && cover == nil {
+		return false
+	}
+
+	root := dns.Fqdn(rootname)
+	types := func(name string) []uint16 {
+		return h.types(name, root)
+	}
+
+	_, ecfg := h.st.currentEngine()
+	rrs, err := denialRRs(root, soa, uint32(h.st.cfg.SOAMinTTL), match, cover, types, ecfg.ZSK, ecfg.ZSKPrivate)
+	if err != nil {
+		log.Errore(err, "couldn't sign NSEC3 record")
+		return false
+	}
+
+	if len(rrs) == 0 {
+		return false
+	}
+
+	m.Ns = append(m.Ns, rrs...)
+	return true
+}
+
+// Returns the NSEC3 records matching the hashes of the names in match and
+// covering those of the names in cover, each followed by its signature. They
+// belong to the zone at root, whose ZSK is key, whatever the owner of soa,
+// the SOA of the response; only its negative TTL is used, or defaultTTL if
+// there is none.
+func denialRRs(root string, soa *dns.SOA, defaultTTL uint32, match, cover []string,
+	types func(name string) []uint16, key *dns.DNSKEY, privateKey crypto.PrivateKey) ([]dns.RR, error) {
+
+	ttl := defaultTTL
+	if soa != nil {
+		ttl = soa.Minttl
+	}
+
+	added := map[string]struct{}{}
+	var nsec3s []*dns.NSEC3
+	add := func(nsec3 *dns.NSEC3) {
+		if nsec3 == nil {
+			return
+		}
+
+		if _, ok := added[nsec3.Hdr.Name]; ok {
+			return
+		}
+
+		added[nsec3.Hdr.Name] = struct{}{}
+		nsec3s = append(nsec3s, nsec3)
+	}
+
+	for _, name := range match {
+		hash := dns.HashName(name, dns.SHA1, nsec3Iterations, nsec3Salt)
+		add(newNSEC3(hash, nsec3Adjacent(hash, true), root, ttl, types(name)))
+	}
+
+	for _, name := range cover {
+		if name == "" {
+			continue
+		}
+
+		hash := dns.HashName(name, dns.SHA1, nsec3Iterations, nsec3Salt)
+		add(newNSEC3(nsec3Adjacent(hash, false), nsec3Adjacent(hash, true), root, ttl, nil))
+	}
+
+	var rrs []dns.RR
+	for _, nsec3 := range nsec3s {
+		sig, err := signRRset([]dns.RR{nsec3}, key, privateKey, root)
+		if err != nil {
+			return nil, err
+		}
+
+		rrs = append(rrs, nsec3, sig)
+	}
+
+	return rrs, nil
+}
+
+// Per RFC 5155 section 7.2, returns the names whose hashes must be matched,
+// and those whose hashes must be covered, to prove that the response m to a
+// query for qname is complete. Both are nil if no proof is needed.
+func denialNames(res *backend.LookupResult, qname string, m *dns.Msg) (match, cover []string) {
+	switch {
+	case res.NXDomain:
+		match = []string{res.ClosestEncloser}
+		cover = []string{res.NextCloser(qname), "*." + res.ClosestEncloser}
+
+	case res.Delegation != "":
+		if m.Rcode != dns.RcodeSuccess || hasType(res.RRs, res.Delegation, dns.TypeDS) {
+			return nil, nil
+		}
+
+		match = []string{res.Delegation}
+
+	case len(m.Answer) > 0:
+		if res.Wildcard == "" {
+			return nil, nil
+		}
+
+		cover = []string{res.NextCloser(qname)}
+
+	case res.Wildcard != "":
+		match = []string{res.ClosestEncloser, res.Wildcard}
+		cover = []string{res.NextCloser(qname)}
+
+	default:
+		match = []string{qname}
+	}
+
+	return
+}
+
+// Returns the types of the records at name, for the type bitmap of its NSEC3
+// record. root is the apex of the anchor, where the DNSKEY RRset is.
+func (h *denialHandler) types(name, root string) []uint16 {
+	res, err := h.st.backend.LookupDetail(name, h.streamIsolationID)
+	if err != nil || res.NXDomain {
+		return nil
+	}
+
+	seen := map[uint16]struct{}{}
+	for _, rr := range res.RRs {
+		if dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(name) {
+			seen[rr.Header().Rrtype] = struct{}{}
+		}
+	}
+
+	if name == root {
+		seen[dns.TypeDNSKEY] = struct{}{}
+	}
+
+	// Every authoritative RRset is signed, but at an unsigned delegation
+	// only the NSEC3 record itself is.
+	_, hasDS := seen[dns.TypeDS]
+	if len(seen) > 0 && (res.Delegation != name || hasDS) {
+		seen[dns.TypeRRSIG] = struct{}{}
+	}
+
+	var types []uint16
+	for t := range seen {
+		types = append(types, t)
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	return types
+}
+
+// Signs an RRset with key, for the zone apex.
+func signRRset(rrs []dns.RR, key *dns.DNSKEY, privateKey crypto.PrivateKey, apex string) (*dns.RRSIG, error) {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrs[0].Header().Ttl,
+		},
+		Algorithm:  key.Algorithm,
+		KeyTag:     key.KeyTag(),
+		SignerName: apex,
+		Inception:  uint32(now.Add(-sigInception).Unix()),
+		Expiration: uint32(now.Add(sigExpiration).Unix()),
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, dns.ErrPrivKey
+	}
+
+	err := sig.Sign(signer, rrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+func newNSEC3(ownerHash, nextHash, apex string, ttl uint32, types []uint16) *dns.NSEC3 {
+	if ownerHash == "" || nextHash == "" {
+		return nil
+	}
+
+	return &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   strings.ToLower(ownerHash) + "." + apex,
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Hash:       dns.SHA1,
+		Iterations: nsec3Iterations,
+		Salt:       nsec3Salt,
+		HashLength: 20,
+		NextDomain: nextHash,
+		TypeBitMap: types,
+	}
+}
+
+// Returns the NSEC3 hash (in base32hex) immediately after hash if up is true,
+// or immediately before it otherwise, wrapping around as the hash space does.
+// Returns "" if hash is malformed.
+func nsec3Adjacent(hash string, up bool) string {
+	b, err := nsec3Encoding.DecodeString(strings.ToUpper(hash))
+	if err != nil || len(b) == 0 {
+		return ""
+	}
+
+	for i := len(b) - 1; i >= 0; i-- {
+		if up {
+			b[i]++
+			if b[i] != 0 {
+				break
+			}
+		} else {
+			b[i]--
+			if b[i] != 0xff {
+				break
+			}
+		}
+	}
+
+	return nsec3Encoding.EncodeToString(b)
+}
+
+func hasType(rrs []dns.RR, name string, t uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t && dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(name) {
+			return true
+		}
+	}
+
+	return false
+}
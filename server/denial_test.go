@@ -0,0 +1,191 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+func TestNSEC3Adjacent(t *testing.T) {
+	tests := []struct {
+		hash     string
+		up       bool
+		expected string
+	}{
+		{"00000000000000000000000000000000", true, "00000000000000000000000000000001"},
+		{"0000000000000000000000000000000V", true, "00000000000000000000000000000010"},
+		{"00000000000000000000000000000010", false, "0000000000000000000000000000000V"},
+		{"1vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv", true, "20000000000000000000000000000000"},
+
+		// The hash space wraps around.
+		{"VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVV", true, "00000000000000000000000000000000"},
+		{"00000000000000000000000000000000", false, "VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVV"},
+
+		{"not base32hex!", true, ""},
+		{"", true, ""},
+	}
+
+	for _, tst := range tests {
+		if h := nsec3Adjacent(tst.hash, tst.up); h != tst.expected {
+			t.Errorf("nsec3Adjacent(%q, %v) = %q, expected %q", tst.hash, tst.up, h, tst.expected)
+		}
+	}
+}
+
+func TestDenialNames(t *testing.T) {
+	a, err := dns.NewRR("www.example.bit. 600 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := dns.NewRR("deleg.example.bit. 600 IN DS 1 8 2 0123456789ABCDEF")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := dns.NewRR("deleg.example.bit. 600 IN NS ns1.example.net.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc   string
+		qname  string
+		res    backend.LookupResult
+		rcode  int
+		answer []dns.RR
+		match  []string
+		cover  []string
+	}{
+		{
+			desc:  "NXDOMAIN",
+			qname: "a.b.example.bit.",
+			res:   backend.LookupResult{NXDomain: true, ClosestEncloser: "example.bit."},
+			rcode: dns.RcodeNameError,
+			match: []string{"example.bit."},
+			cover: []string{"b.example.bit.", "*.example.bit."},
+		},
+		{
+			desc:  "NODATA",
+			qname: "www.example.bit.",
+			res:   backend.LookupResult{ClosestEncloser: "www.example.bit."},
+			match: []string{"www.example.bit."},
+		},
+		{
+			desc:   "answer",
+			qname:  "www.example.bit.",
+			res:    backend.LookupResult{RRs: []dns.RR{a}, ClosestEncloser: "www.example.bit."},
+			answer: []dns.RR{a},
+		},
+		{
+			desc:   "wildcard answer",
+			qname:  "a.b.example.bit.",
+			res:    backend.LookupResult{RRs: []dns.RR{a}, ClosestEncloser: "example.bit.", Wildcard: "*.example.bit."},
+			answer: []dns.RR{a},
+			cover:  []string{"b.example.bit."},
+		},
+		{
+			desc:  "wildcard NODATA",
+			qname: "a.b.example.bit.",
+			res:   backend.LookupResult{ClosestEncloser: "example.bit.", Wildcard: "*.example.bit."},
+			match: []string{"example.bit.", "*.example.bit."},
+			cover: []string{"b.example.bit."},
+		},
+		{
+			desc:  "unsigned referral",
+			qname: "www.deleg.example.bit.",
+			res:   backend.LookupResult{RRs: []dns.RR{ns}, ClosestEncloser: "deleg.example.bit.", Delegation: "deleg.example.bit."},
+			match: []string{"deleg.example.bit."},
+		},
+		{
+			desc:  "signed referral",
+			qname: "www.deleg.example.bit.",
+			res:   backend.LookupResult{RRs: []dns.RR{ns, ds}, ClosestEncloser: "deleg.example.bit.", Delegation: "deleg.example.bit."},
+		},
+		{
+			desc:  "referral with an error",
+			qname: "www.deleg.example.bit.",
+			res:   backend.LookupResult{RRs: []dns.RR{ns}, ClosestEncloser: "deleg.example.bit.", Delegation: "deleg.example.bit."},
+			rcode: dns.RcodeServerFailure,
+		},
+	}
+
+	for _, tst := range tests {
+		m := &dns.Msg{Answer: tst.answer}
+		m.Rcode = tst.rcode
+
+		match, cover := denialNames(&tst.res, tst.qname, m)
+		if !reflect.DeepEqual(match, tst.match) || !reflect.DeepEqual(cover, tst.cover) {
+			t.Errorf("%s: got match %q, cover %q; expected match %q, cover %q",
+				tst.desc, match, cover, tst.match, tst.cover)
+		}
+	}
+}
+
+func TestDenialRRs(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "bit.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 600},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	privateKey, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A per-domain SOA only lends its negative TTL; the records are still
+	// those of the anchor's zone.
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.bit.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600},
+		Minttl: 300,
+	}
+
+	types := func(name string) []uint16 {
+		return []uint16{dns.TypeA, dns.TypeRRSIG}
+	}
+
+	rrs, err := denialRRs("bit.", soa, 600, []string{"example.bit."},
+		[]string{"b.example.bit.", "*.example.bit."}, types, key, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rrs) != 6 {
+		t.Fatalf("got %d records, expected 3 NSEC3 records and their signatures: %v", len(rrs), rrs)
+	}
+
+	for i := 0; i < len(rrs); i += 2 {
+		nsec3, ok := rrs[i].(*dns.NSEC3)
+		if !ok {
+			t.Fatalf("record %d is not an NSEC3 record: %v", i, rrs[i])
+		}
+
+		sig, ok := rrs[i+1].(*dns.RRSIG)
+		if !ok {
+			t.Fatalf("record %d is not an RRSIG: %v", i+1, rrs[i+1])
+		}
+
+		labels := dns.SplitDomainName(nsec3.Hdr.Name)
+		if len(labels) != 2 || !strings.HasSuffix(nsec3.Hdr.Name, ".bit.") {
+			t.Errorf("NSEC3 owner %q is not a hash directly beneath bit.", nsec3.Hdr.Name)
+		}
+
+		if nsec3.Hdr.Ttl != 300 {
+			t.Errorf("NSEC3 TTL is %d, expected the SOA's negative TTL, 300", nsec3.Hdr.Ttl)
+		}
+
+		if sig.SignerName != "bit." {
+			t.Errorf("signer name is %q, expected bit.", sig.SignerName)
+		}
+
+		if err := sig.Verify(key, []dns.RR{nsec3}); err != nil {
+			t.Errorf("signature of %s doesn't verify: %v", nsec3.Hdr.Name, err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package server
+
+import "net/http"
+import "net"
+import "io"
+import "io/ioutil"
+import "encoding/base64"
+import "encoding/json"
+import "strconv"
+import "strings"
+import "fmt"
+import "github.com/miekg/dns"
+
+// DNS-over-HTTPS (RFC 8484) and the JSON API variant of it offered by some
+// public resolvers. Queries are answered by the same engine as the UDP and
+// TCP listeners.
+
+const dohMessageType = "application/dns-message"
+const dohJSONType = "application/dns-json"
+
+// Largest DNS message which can be sent in a DoH request.
+const dohMaxMessageSize = 65535
+
+func (ws *webServer) handleDNSQuery(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" && (req.FormValue("name") != "" ||
+		strings.Contains(req.Header.Get("Accept"), dohJSONType) ||
+		req.FormValue("ct") == dohJSONType) {
+		ws.handleDNSJSON(rw, req)
+		return
+	}
+
+	var wire []byte
+	var err error
+	switch req.Method {
+	case "GET":
+		wire, err = base64.RawURLEncoding.DecodeString(req.FormValue("dns"))
+		if err != nil || len(wire) == 0 {
+			http.Error(rw, "missing or malformed dns parameter", http.StatusBadRequest)
+			return
+		}
+
+	case "POST":
+		if req.Header.Get("Content-Type") != dohMessageType {
+			http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		wire, err = ioutil.ReadAll(io.LimitReader(req.Body, dohMaxMessageSize+1))
+		if err != nil {
+			http.Error(rw, "couldn't read request", http.StatusBadRequest)
+			return
+		}
+
+		if len(wire) > dohMaxMessageSize {
+			http.Error(rw, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := new(dns.Msg)
+	err = q.Unpack(wire)
+	if err != nil {
+		http.Error(rw, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	res := ws.serveDoH(q, req)
+	out, err := res.Pack()
+	if err != nil {
+		log.Errore(err, "couldn't pack DoH response")
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", dohMessageType)
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(res)))
+	_, err = rw.Write(out)
+	log.Infoe(err, "couldn't write DoH response")
+}
+
+// The JSON API. Accepts the parameters name, type (a mnemonic or number,
+// default A), cd and do.
+func (ws *webServer) handleDNSJSON(rw http.ResponseWriter, req *http.Request) {
+	name := req.FormValue("name")
+	if name == "" || len(name) > 253 {
+		http.Error(rw, "missing or malformed name parameter", http.StatusBadRequest)
+		return
+	}
+
+	qtype := dns.TypeA
+	if t := req.FormValue("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			http.Error(rw, "malformed type parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	q.CheckingDisabled = dohFlag(req.FormValue("cd"))
+	if dohFlag(req.FormValue("do")) {
+		q.SetEdns0(4096, true)
+	}
+
+	res := ws.serveDoH(q, req)
+
+	out, err := json.Marshal(dohJSONResponse(res))
+	if err != nil {
+		log.Errore(err, "couldn't marshal DoH JSON response")
+		http.Error(rw, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", dohJSONType)
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(res)))
+	_, err = rw.Write(out)
+	log.Infoe(err, "couldn't write DoH JSON response")
+}
+
+// Answers a query received over DoH. Zone transfers need a stream of
+// messages and aren't offered over DoH.
+func (ws *webServer) serveDoH(q *dns.Msg, req *http.Request) *dns.Msg {
+	if len(q.Question) == 1 && (q.Question[0].Qtype == dns.TypeAXFR || q.Question[0].Qtype == dns.TypeIXFR) {
+		return new(dns.Msg).SetRcode(q, dns.RcodeNotImplemented)
+	}
+
+	w := &dohResponseWriter{
+		remoteAddr: dohAddr(req.RemoteAddr),
+	}
+	if la, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.localAddr = la
+	}
+
+	ws.s.current().queries.ServeDNS(w, q)
+
+	if w.msg == nil {
+		return new(dns.Msg).SetRcode(q, dns.RcodeServerFailure)
+	}
+
+	return w.msg
+}
+
+// The cache lifetime of a DoH response is the smallest TTL of the records in
+// it (RFC 8484 section 5.1).
+func dohMaxAge(m *dns.Msg) uint32 {
+	var maxAge uint32
+	first := true
+	for _, sec := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range sec {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if first || rr.Header().Ttl < maxAge {
+				maxAge = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+
+	return maxAge
+}
+
+func dohFlag(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+func dohAddr(remoteAddr string) net.Addr {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type dohJSON struct {
+	Status    int               `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []dohJSONQuestion `json:"Question"`
+	Answer    []dohJSONRR       `json:"Answer,omitempty"`
+	Authority []dohJSONRR       `json:"Authority,omitempty"`
+}
+
+func dohJSONResponse(m *dns.Msg) *dohJSON {
+	j := &dohJSON{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+
+	for _, q := range m.Question {
+		j.Question = append(j.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+
+	j.Answer = dohJSONRRs(m.Answer)
+	j.Authority = dohJSONRRs(m.Ns)
+	return j
+}
+
+func dohJSONRRs(rrs []dns.RR) []dohJSONRR {
+	var out []dohJSONRR
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		out = append(out, dohJSONRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+
+	return out
+}
+
+// Captures the response to a query received over DoH.
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	if w.localAddr == nil {
+		return &net.TCPAddr{}
+	}
+	return w.localAddr
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	err := m.Unpack(b)
+	if err != nil {
+		return 0, err
+	}
+
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+// TSIG isn't supported over DoH, so a signed request is never treated as
+// verified.
+func (w *dohResponseWriter) TsigStatus() error {
+	return dns.ErrSig
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (w *dohResponseWriter) Hijack() {
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"container/list"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	madns "gopkg.in/hlandau/madns.v2"
+
+	"github.com/namecoin/ncdns/backend"
+)
+
+// Returns the TLS configuration for the DNS-over-TLS (RFC 7858) listeners.
+func dotTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.DoTCertFile == "" || cfg.DoTKeyFile == "" {
+		return nil, fmt.Errorf("DNS-over-TLS requires DoTCertFile and DoTKeyFile to be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.cpath(cfg.DoTCertFile), cfg.cpath(cfg.DoTKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load DNS-over-TLS certificate: %s", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Serves DNS-over-TLS queries. Each client is given its own stream isolation
+// ID, so that names looked up by one client can't be detected by another
+// through the backend's caches.
+type dotHandler struct {
+	s *Server
+}
+
+func (h *dotHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	st := h.s.current()
+
+	// Zone transfers aren't cached per stream, so they are handled as they
+	// would be over plain TCP.
+	if len(r.Question) == 1 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		st.handler.ServeDNS(w, r)
+		return
+	}
+
+	id := dotStreamIsolationID(w)
+	e, err := st.isolatedEngine(id)
+	if err != nil {
+		log.Errore(err, "couldn't create DNS-over-TLS engine")
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		err = w.WriteMsg(m)
+		log.Infoe(err, "couldn't write response")
+		return
+	}
+
+	st.queryHandler(e, id).ServeDNS(w, r)
+}
+
+// Returns the stream isolation ID of the client from which a query was
+// received over TLS. It is derived from the client's address but not its
+// port, so that a client which reconnects, as stub resolvers do whenever a
+// connection goes idle, keeps its cache instead of pushing out those of other
+// clients.
+func dotStreamIsolationID(w dns.ResponseWriter) string {
+	addr := w.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	return "dot:" + addr
+}
+
+// The madns engine has no way to pass a stream isolation ID through to the
+// backend, so each ID needs an engine of its own. Engines are kept, most
+// recently used first, for as many IDs as the backend keeps caches for.
+type dotEngines struct {
+	max int
+
+	mutex   sync.Mutex
+	lru     *list.List
+	engines map[string]*list.Element
+}
+
+type dotEngine struct {
+	id     string
+	engine madns.Engine
+}
+
+func newDotEngines(max int) *dotEngines {
+	return &dotEngines{
+		max:     max,
+		lru:     list.New(),
+		engines: map[string]*list.Element{},
+	}
+}
+
+// Returns the engine for id, creating it with newEngine if there is none.
+func (de *dotEngines) get(id string, newEngine func() (madns.Engine, error)) (madns.Engine, error) {
+	de.mutex.Lock()
+	defer de.mutex.Unlock()
+
+	if elem, ok := de.engines[id]; ok {
+		de.lru.MoveToFront(elem)
+		return elem.Value.(*dotEngine).engine, nil
+	}
+
+	e, err := newEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	if de.max > 0 {
+		for len(de.engines) >= de.max {
+			back := de.lru.Back()
+			de.lru.Remove(back)
+			delete(de.engines, back.Value.(*dotEngine).id)
+		}
+	}
+
+	de.engines[id] = de.lru.PushFront(&dotEngine{id: id, engine: e})
+	return e, nil
+}
+
+// Discards every engine, so that they are recreated from a new engine
+// configuration.
+func (de *dotEngines) reset() {
+	de.mutex.Lock()
+	defer de.mutex.Unlock()
+
+	de.lru.Init()
+	de.engines = map[string]*list.Element{}
+}
+
+// Returns an engine answering queries from the state's backend using the
+// given stream isolation ID.
+func (st *state) isolatedEngine(streamIsolationID string) (madns.Engine, error) {
+	// Held so that setZSK can't replace the configuration between an
+	// engine being built from it and being stored.
+	st.engineMutex.RLock()
+	defer st.engineMutex.RUnlock()
+
+	return st.dotEngines.get(streamIsolationID, func() (madns.Engine, error) {
+		ecfg := st.engineConfig
+		ecfg.Backend = &isolatedBackend{
+			b:                 st.backend,
+			streamIsolationID: streamIsolationID,
+		}
+
+		return madns.NewEngine(&ecfg)
+	})
+}
+
+// A backend which looks up every name using a fixed stream isolation ID.
+type isolatedBackend struct {
+	b                 *backend.Backend
+	streamIsolationID string
+}
+
+func (ib *isolatedBackend) Lookup(qname, streamIsolationID string) ([]dns.RR, error) {
+	return ib.b.Lookup(qname, ib.streamIsolationID)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"testing"
+
+	madns "gopkg.in/hlandau/madns.v2"
+)
+
+func TestDotEngines(t *testing.T) {
+	de := newDotEngines(2)
+
+	created := 0
+	get := func(id string) {
+		_, err := de.get(id, func() (madns.Engine, error) {
+			created++
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("a")
+	get("b")
+	get("a")
+	if created != 2 {
+		t.Fatalf("created %d engines for 2 IDs, expected 2", created)
+	}
+
+	// "b" is the least recently used, so it makes way for "c".
+	get("c")
+	get("a")
+	if created != 3 {
+		t.Fatalf("created %d engines, expected 3", created)
+	}
+
+	get("b")
+	if created != 4 {
+		t.Fatalf("created %d engines, expected 4 after eviction", created)
+	}
+
+	de.reset()
+	get("b")
+	if created != 5 {
+		t.Fatalf("created %d engines, expected 5 after reset", created)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a handler which answers queries using e, which must not be asked
+// for zone transfers. If the zone is signed, the DNSKEY RRset is completed
+// with any managed keys not used for signing, and NSEC3 records are added to
+// negative responses.
+func (st *state) queryHandler(e dns.Handler, streamIsolationID string) dns.Handler {
+	h := e
+	if st.keys != nil {
+		h = &dnskeyHandler{st: st, next: h}
+	}
+
+	if _, ecfg := st.currentEngine(); ecfg.ZSK != nil {
+		h = &denialHandler{
+			st:                st,
+			next:              h,
+			streamIsolationID: streamIsolationID,
+		}
+	}
+
+	return h
+}
+
+// Passes each response through hook before writing it. hook is given the
+// request and response, and returns true if it changed the response.
+type hookWriter struct {
+	dns.ResponseWriter
+	req  *dns.Msg
+	hook func(r, m *dns.Msg) bool
+}
+
+func (w *hookWriter) WriteMsg(m *dns.Msg) error {
+	if !w.hook(w.req, m) {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	// Added records may push a UDP response over the size limit.
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := w.req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+
+		if m.Len() > size {
+			m.Truncate(size)
+		}
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *hookWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return w.ResponseWriter.Write(b)
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
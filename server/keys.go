@@ -0,0 +1,486 @@
+package server
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Generates, stores and rolls over the server's DNSSEC keys, so that they
+// need not be created by hand. The keys are kept in a state directory as
+// BIND-style K<zone>+<algorithm>+<tag>.key and .private files, together with
+// keys.json, which records the role and state of each key.
+//
+// The KSK is generated once and never rolled automatically, since a new KSK
+// requires the trust anchor to be updated. ZSKs are rolled using the
+// pre-publication method (RFC 6781 section 4.1.1.1): a new ZSK is added to
+// the DNSKEY RRset a while before it is used for signing, and the old one
+// remains published for the same period after it is retired, so that
+// validators holding cached copies of either the DNSKEY RRset or of
+// signatures are never left without the key they need.
+type keyManager struct {
+	dir        string
+	zones      []string
+	algorithm  uint8
+	rollover   time.Duration
+	prepublish time.Duration
+
+	mutex sync.Mutex
+	keys  []*managedKey
+}
+
+// The states a managed key passes through. KSKs are only ever active.
+const (
+	keyPublished = "published"
+	keyActive    = "active"
+	keyRetired   = "retired"
+)
+
+type managedKey struct {
+	// Base name of the key's files, without the .key or .private suffix.
+	File  string    `json:"file"`
+	KSK   bool      `json:"ksk"`
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+
+	dnskey     *dns.DNSKEY
+	privateKey crypto.PrivateKey
+}
+
+type keyState struct {
+	Keys []*managedKey `json:"keys"`
+}
+
+const keyStateFile = "keys.json"
+
+// Interval at which the key manager checks whether a rollover step is due.
+const keyCheckInterval = time.Hour
+
+var keyAlgorithms = map[string]uint8{
+	"ecdsap256sha256": dns.ECDSAP256SHA256,
+	"ed25519":         dns.ED25519,
+}
+
+// Loads the managed keys from cfg.KeyDir, generating a KSK and ZSK if there
+// are none yet.
+func newKeyManager(cfg *Config, anchors []string) (*keyManager, error) {
+	algorithm, ok := keyAlgorithms[strings.ToLower(cfg.KeyAlgorithm)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key algorithm %q; must be ecdsap256sha256 or ed25519", cfg.KeyAlgorithm)
+	}
+
+	km := &keyManager{
+		dir:        cfg.cpath(cfg.KeyDir),
+		zones:      anchors,
+		algorithm:  algorithm,
+		rollover:   time.Duration(cfg.ZSKRolloverInterval) * time.Second,
+		prepublish: time.Duration(cfg.ZSKPrePublish) * time.Second,
+	}
+
+	if km.rollover > 0 && km.rollover <= km.prepublish {
+		return nil, fmt.Errorf("zskrolloverinterval must be longer than zskprepublish")
+	}
+
+	err := os.MkdirAll(km.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = km.load()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	now := time.Now()
+	for _, ksk := range []bool{true, false} {
+		if km.activeKey(ksk) != nil {
+			continue
+		}
+
+		k, err := km.generate(ksk, keyActive, now)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("generated %s %s", keyRole(ksk), k.File)
+		changed = true
+	}
+
+	if changed {
+		err = km.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = km.writeDSSets()
+	if err != nil {
+		return nil, err
+	}
+
+	return km, nil
+}
+
+func keyRole(ksk bool) string {
+	if ksk {
+		return "KSK"
+	}
+	return "ZSK"
+}
+
+func (km *keyManager) load() error {
+	b, err := ioutil.ReadFile(filepath.Join(km.dir, keyStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var ks keyState
+	err = json.Unmarshal(b, &ks)
+	if err != nil {
+		return fmt.Errorf("couldn't parse %s: %v", keyStateFile, err)
+	}
+
+	for _, k := range ks.Keys {
+		fn := filepath.Join(km.dir, k.File)
+		k.dnskey, k.privateKey, err = readKeyPair(fn+".key", fn+".private")
+		if err != nil {
+			return err
+		}
+	}
+
+	km.keys = ks.Keys
+	return nil
+}
+
+// Writes keys.json, replacing it atomically.
+func (km *keyManager) save() error {
+	b, err := json.MarshalIndent(&keyState{Keys: km.keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fn := filepath.Join(km.dir, keyStateFile)
+	err = ioutil.WriteFile(fn+".tmp", b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fn+".tmp", fn)
+}
+
+// Generates a new key and writes its files. The key state is not saved.
+func (km *keyManager) generate(ksk bool, state string, now time.Time) (*managedKey, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   km.zones[0],
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: km.algorithm,
+	}
+	if ksk {
+		dnskey.Flags |= dns.SEP
+	}
+
+	privateKey, err := dnskey.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &managedKey{
+		File:       fmt.Sprintf("K%s+%03d+%05d", km.zones[0], dnskey.Algorithm, dnskey.KeyTag()),
+		KSK:        ksk,
+		State:      state,
+		Since:      now,
+		dnskey:     dnskey,
+		privateKey: privateKey,
+	}
+
+	fn := filepath.Join(km.dir, k.File)
+	err = ioutil.WriteFile(fn+".private", []byte(dnskey.PrivateKeyString(privateKey)), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(fn+".key", []byte(dnskey.String()+"\n"), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	km.keys = append(km.keys, k)
+	return k, nil
+}
+
+// Writes a dsset-<zone> file for each zone, holding the DS records of the
+// KSK, as needed to configure the trust anchor.
+func (km *keyManager) writeDSSets() error {
+	for _, zone := range km.zones {
+		var lines []string
+		for _, ds := range km.dsSet(zone) {
+			lines = append(lines, ds.String())
+			log.Infof("trust anchor for %s: %s", zone, ds)
+		}
+
+		err := ioutil.WriteFile(filepath.Join(km.dir, "dsset-"+zone), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the DS records of the KSKs for zone.
+func (km *keyManager) dsSet(zone string) []*dns.DS {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	var ksks []*dns.DNSKEY
+	for _, k := range km.keys {
+		if k.KSK {
+			ksks = append(ksks, k.dnskey)
+		}
+	}
+
+	return dsSet(ksks, zone)
+}
+
+// Must be called with mutex held, except during construction.
+func (km *keyManager) activeKey(ksk bool) *managedKey {
+	for _, k := range km.keys {
+		if k.KSK == ksk && k.State == keyActive {
+			return k
+		}
+	}
+
+	return nil
+}
+
+func (km *keyManager) keyInState(state string) *managedKey {
+	for _, k := range km.keys {
+		if !k.KSK && k.State == state {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// Returns the active KSK and ZSK, with which the zones are signed.
+func (km *keyManager) signingKeys() (ksk, zsk *managedKey) {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	return km.activeKey(true), km.activeKey(false)
+}
+
+// Returns the DNSKEY records to publish: every managed key, including ZSKs
+// not yet active or already retired.
+func (km *keyManager) published() []*dns.DNSKEY {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	var dnskeys []*dns.DNSKEY
+	for _, k := range km.keys {
+		dnskeys = append(dnskeys, k.dnskey)
+	}
+
+	return dnskeys
+}
+
+// Carries out any ZSK rollover step which is due at now: publishing a new
+// ZSK, or removing a retired one. If the published ZSK is due to replace the
+// active one, it is returned; the caller must start signing with it and then
+// call activate.
+func (km *keyManager) roll(now time.Time) (next *managedKey, err error) {
+	if km.rollover <= 0 {
+		return nil, nil
+	}
+
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	changed := false
+	active := km.activeKey(false)
+	due := active.Since.Add(km.rollover)
+
+	pending := km.keyInState(keyPublished)
+	if pending == nil && !now.Before(due.Add(-km.prepublish)) {
+		pending, err = km.generate(false, keyPublished, now)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("published new ZSK %s; it becomes active after %s", pending.File, km.prepublish)
+		changed = true
+	}
+
+	if pending != nil && !now.Before(due) && !now.Before(pending.Since.Add(km.prepublish)) {
+		next = pending
+	}
+
+	var keys []*managedKey
+	for _, k := range km.keys {
+		if k.State == keyRetired && !now.Before(k.Since.Add(km.prepublish)) {
+			fn := filepath.Join(km.dir, k.File)
+			log.Errore(os.Remove(fn+".key"), "couldn't remove retired key")
+			log.Errore(os.Remove(fn+".private"), "couldn't remove retired key")
+			log.Infof("removed retired ZSK %s", k.File)
+			changed = true
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+	km.keys = keys
+
+	if changed {
+		err = km.save()
+	}
+
+	return
+}
+
+// Makes next, a key returned by roll, the active ZSK, and retires the one it
+// replaces. If the new state can't be saved, nothing is changed.
+func (km *keyManager) activate(next *managedKey, now time.Time) error {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	active := km.activeKey(false)
+	activeSince, nextState, nextSince := active.Since, next.State, next.Since
+
+	active.State, active.Since = keyRetired, now
+	next.State, next.Since = keyActive, now
+
+	err := km.save()
+	if err != nil {
+		active.State, active.Since = keyActive, activeSince
+		next.State, next.Since = nextState, nextSince
+		return err
+	}
+
+	log.Infof("ZSK %s is now active; retired ZSK %s", next.File, active.File)
+	return nil
+}
+
+// Adds to the DNSKEY RRsets in responses those managed keys which the engine,
+// knowing only the signing keys, does not return, and re-signs the RRsets.
+type dnskeyHandler struct {
+	st   *state
+	next dns.Handler
+}
+
+func (h *dnskeyHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h.next.ServeDNS(&hookWriter{ResponseWriter: w, req: r, hook: h.completeDNSKEY}, r)
+}
+
+func (h *dnskeyHandler) completeDNSKEY(r, m *dns.Msg) bool {
+	var owner string
+	var ttl uint32
+	signed := false
+	var rrs []dns.RR
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			owner, ttl = rr.Hdr.Name, rr.Hdr.Ttl
+			continue
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				signed = true
+				continue
+			}
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	if owner == "" {
+		return false
+	}
+
+	var dnskeys []dns.RR
+	for _, k := range h.st.keys.published() {
+		dnskey := *k
+		dnskey.Hdr.Name = owner
+		dnskey.Hdr.Ttl = ttl
+		dnskeys = append(dnskeys, &dnskey)
+	}
+
+	rrs = append(rrs, dnskeys...)
+
+	if signed {
+		_, ecfg := h.st.currentEngine()
+		sig, err := signRRset(dnskeys, ecfg.KSK, ecfg.KSKPrivate, owner)
+		if err != nil {
+			log.Errore(err, "couldn't sign DNSKEY RRset")
+			return false
+		}
+
+		rrs = append(rrs, sig)
+	}
+
+	m.Answer = rrs
+	return true
+}
+
+// Periodically carries out ZSK rollover steps, switching the engine over to
+// each new ZSK before it is recorded as active.
+func (s *Server) manageKeys() {
+	ticker := time.NewTicker(keyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		next, err := s.keys.roll(time.Now())
+		log.Errore(err, "ZSK rollover failed")
+
+		if next != nil {
+			err = s.activateZSK(next)
+			log.Errore(err, "couldn't start signing with the new ZSK")
+		}
+
+		select {
+		case <-s.keysQuit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Switches the current state's engine to the ZSK next, then records it as
+// active. If it can't be recorded, the engine is switched back.
+func (s *Server) activateZSK(next *managedKey) error {
+	// A reload meanwhile would build its engine from the keys as they were.
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	_, active := s.keys.signingKeys()
+	st := s.current()
+
+	err := st.setZSK(next.dnskey, next.privateKey)
+	if err != nil {
+		return err
+	}
+
+	err = s.keys.activate(next, time.Now())
+	if err != nil {
+		log.Errore(st.setZSK(active.dnskey, active.privateKey), "couldn't switch back to the active ZSK")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// The name (systemd FileDescriptorName=) which marks an inherited socket as a
+// DNS-over-TLS listener.
+const dotFDName = "dot"
+
+// Opens the DNS listeners. Sockets passed by systemd socket activation are
+// used if there are any; otherwise the addresses in Bind are bound. The same
+// goes for DNS-over-TLS, with sockets named "dot" and DoTBind.
+func (s *Server) openListeners(cfg *Config) (err error) {
+	defer func() {
+		if err != nil {
+			s.closeListeners()
+		}
+	}()
+
+	var dotConfig *tls.Config
+	if cfg.DoTBind != "" {
+		dotConfig, err = dotTLSConfig(cfg)
+		if err != nil {
+			return
+		}
+	}
+
+	files, err := activationFiles()
+	if err != nil {
+		return
+	}
+
+	var inheritedDoT bool
+	for name, fs := range files {
+		for _, f := range fs {
+			if name == dotFDName {
+				inheritedDoT = true
+				if dotConfig == nil {
+					dotConfig, err = dotTLSConfig(cfg)
+					if err != nil {
+						return
+					}
+				}
+			}
+
+			err = s.addInherited(f, name == dotFDName, dotConfig)
+			f.Close()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if len(s.udpConns) == 0 && len(s.tcpListeners) == 0 {
+		for _, addr := range splitAddrs(cfg.Bind) {
+			err = s.bind(addr)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if !inheritedDoT {
+		for _, addr := range splitAddrs(cfg.DoTBind) {
+			var l net.Listener
+			l, err = net.Listen("tcp", addr)
+			if err != nil {
+				return
+			}
+
+			s.dotListeners = append(s.dotListeners, tls.NewListener(l, dotConfig))
+		}
+	}
+
+	if len(s.udpConns) == 0 && len(s.tcpListeners) == 0 && len(s.dotListeners) == 0 {
+		return fmt.Errorf("no addresses to listen on")
+	}
+
+	return nil
+}
+
+// Binds UDP and TCP on addr.
+func (s *Server) bind(addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return err
+	}
+
+	s.tcpListeners = append(s.tcpListeners, tcpListener)
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+
+	s.udpConns = append(s.udpConns, udpConn)
+	return nil
+}
+
+// Adds a socket inherited through socket activation. Stream sockets are
+// served as DNS over TCP, or DNS-over-TLS if dot is set; datagram sockets as
+// DNS over UDP. The file is duplicated, so the caller should close it.
+func (s *Server) addInherited(f *os.File, dot bool, dotConfig *tls.Config) error {
+	if l, err := net.FileListener(f); err == nil {
+		if dot {
+			s.dotListeners = append(s.dotListeners, tls.NewListener(l, dotConfig))
+		} else {
+			s.tcpListeners = append(s.tcpListeners, l)
+		}
+
+		return nil
+	}
+
+	if dot {
+		return fmt.Errorf("inherited DNS-over-TLS socket %s is not a stream socket", f.Name())
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return fmt.Errorf("couldn't use inherited socket %s: %s", f.Name(), err)
+	}
+
+	s.udpConns = append(s.udpConns, pc)
+	return nil
+}
+
+// Closes any listeners which have been opened. Used when the listeners were
+// never handed to DNS servers.
+func (s *Server) closeListeners() error {
+	var errs []error
+	for _, pc := range s.udpConns {
+		errs = append(errs, pc.Close())
+	}
+
+	for _, l := range s.tcpListeners {
+		errs = append(errs, l.Close())
+	}
+
+	for _, l := range s.dotListeners {
+		errs = append(errs, l.Close())
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the sockets passed by systemd socket activation (see
+// sd_listen_fds(3)), grouped by name. Sockets without a name are grouped under
+// the empty string. The environment variables are unset, so that they aren't
+// passed on to child processes.
+func activationFiles() (map[string][]*os.File, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	fds := activationFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if fds == nil {
+		return nil, nil
+	}
+
+	files := map[string][]*os.File{}
+	for name, nfds := range fds {
+		for _, fd := range nfds {
+			files[name] = append(files[name], os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+		}
+	}
+
+	return files, nil
+}
+
+// Returns the file descriptors described by the socket activation
+// environment variables, grouped by name, or nil if they weren't passed to
+// the process with the given pid.
+func activationFDs(listenPID, listenFDs, listenFDNames string, pid int) map[string][]int {
+	p, err := strconv.Atoi(listenPID)
+	if err != nil || p != pid {
+		return nil
+	}
+
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	names := strings.Split(listenFDNames, ":")
+
+	fds := map[string][]int{}
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) && names[i] != "unknown" {
+			name = names[i]
+		}
+
+		fds[name] = append(fds[name], listenFDsStart+i)
+	}
+
+	return fds
+}
+
+// Splits a comma-separated list of addresses.
+func splitAddrs(addrs string) []string {
+	var out []string
+	for _, a := range strings.Split(addrs, ",") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			out = append(out, a)
+		}
+	}
+
+	return out
+}
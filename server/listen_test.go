@@ -0,0 +1,56 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestActivationFDs(t *testing.T) {
+	tests := []struct {
+		pid, fds, names string
+		expected        map[string][]int
+	}{
+		// Not socket activated, or meant for another process.
+		{"", "", "", nil},
+		{"42", "2", "", nil},
+		{"x", "2", "", nil},
+
+		{"100", "0", "", nil},
+		{"100", "x", "", nil},
+		{"100", "2", "", map[string][]int{"": {3, 4}}},
+		{"100", "3", "dns:dns:dot", map[string][]int{"dns": {3, 4}, "dot": {5}}},
+
+		// "unknown" is what systemd passes for sockets without a name.
+		{"100", "2", "unknown:dot", map[string][]int{"": {3}, "dot": {4}}},
+
+		// Missing names are treated as unnamed.
+		{"100", "3", "dot", map[string][]int{"dot": {3}, "": {4, 5}}},
+	}
+
+	for _, tst := range tests {
+		fds := activationFDs(tst.pid, tst.fds, tst.names, 100)
+		if !reflect.DeepEqual(fds, tst.expected) {
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q LISTEN_FDNAMES=%q: got %v, expected %v",
+				tst.pid, tst.fds, tst.names, fds, tst.expected)
+		}
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	tests := []struct {
+		addrs    string
+		expected []string
+	}{
+		{"", nil},
+		{" , ", nil},
+		{"127.0.0.1:53", []string{"127.0.0.1:53"}},
+		{"127.0.0.1:53, [::1]:53,", []string{"127.0.0.1:53", "[::1]:53"}},
+	}
+
+	for _, tst := range tests {
+		addrs := splitAddrs(tst.addrs)
+		if !reflect.DeepEqual(addrs, tst.expected) {
+			t.Errorf("%q: got %q, expected %q", tst.addrs, addrs, tst.expected)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Sends DNS NOTIFY messages (RFC 1996) to secondary nameservers whenever a
+// new block arrives, so that they refresh promptly instead of waiting for the
+// SOA refresh interval. Optionally, the zone is walked first and secondaries
+// are only notified if its contents changed.
+type notifier struct {
+	st      *state
+	xfr     *xfrHandler
+	targets []string
+	zones   []string
+
+	trigger chan struct{}
+	quit    chan struct{}
+
+	// Incremented, per zone, for every round of notifications. A target which
+	// is still being retried gives up once a newer round has started.
+	mutex  sync.Mutex
+	rounds map[string]uint64
+}
+
+// Number of attempts made to notify each target, and the delay before the
+// first retry. The delay doubles after each attempt.
+const notifyAttempts = 5
+const notifyRetryDelay = 5 * time.Second
+
+func newNotifier(st *state) *notifier {
+	n := &notifier{
+		st:      st,
+		xfr:     st.xfr,
+		trigger: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		rounds:  map[string]uint64{},
+	}
+
+	for _, t := range strings.Split(st.cfg.NotifyTargets, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			t = net.JoinHostPort(t, "53")
+		}
+
+		n.targets = append(n.targets, t)
+	}
+
+	for _, a := range st.cfg.anchors {
+		n.zones = append(n.zones, dns.Fqdn(a.Suffix))
+	}
+
+	return n
+}
+
+// Called by the backend whenever the chain tip changes. Notifications are
+// sent from the notifier's own goroutine, so this never blocks.
+func (n *notifier) chainTipChanged(height int64, hash string) {
+	select {
+	case n.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (n *notifier) run() {
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-n.trigger:
+		}
+
+		for _, zone := range n.zones {
+			soa, err := n.changedSOA(zone)
+			if err != nil {
+				log.Errore(err, "couldn't determine the SOA of zone ", zone, "; not sending NOTIFY")
+				continue
+			}
+
+			if soa != nil {
+				n.notifyAll(zone, soa)
+			}
+		}
+	}
+}
+
+// Returns the current SOA of zone, or nil if secondaries need not be notified.
+// Unless NotifyCheckChanges is set, the zone is not walked, and every new
+// serial is notified.
+func (n *notifier) changedSOA(zone string) (*dns.SOA, error) {
+	if n.st.cfg.NotifyCheckChanges {
+		v, changed, err := n.xfr.zoneChanged(zone)
+		if err != nil {
+			return nil, err
+		}
+
+		if !changed {
+			log.Debugf("zone %s unchanged at serial %d; not sending NOTIFY", zone, v.soa.Serial)
+			return nil, nil
+		}
+
+		return v.soa, nil
+	}
+
+	res, err := n.st.backend.LookupDetail(zone, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rr := range res.RRs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no SOA at zone apex")
+}
+
+// Stops sending notifications, including retries in progress.
+func (n *notifier) stop() {
+	close(n.quit)
+}
+
+func (n *notifier) notifyAll(zone string, soa *dns.SOA) {
+	n.mutex.Lock()
+	n.rounds[zone]++
+	round := n.rounds[zone]
+	n.mutex.Unlock()
+
+	for _, t := range n.targets {
+		go n.notify(t, zone, soa, round)
+	}
+}
+
+func (n *notifier) superseded(zone string, round uint64) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.rounds[zone] != round
+}
+
+func (n *notifier) notify(target, zone string, soa *dns.SOA, round uint64) {
+	delay := notifyRetryDelay
+
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		err := n.send(target, zone, soa)
+		if err == nil {
+			log.Infof("sent NOTIFY for %s serial %d to %s", zone, soa.Serial, target)
+			return
+		}
+
+		log.Warnf("NOTIFY for %s serial %d to %s failed (attempt %d of %d): %v",
+			zone, soa.Serial, target, attempt, notifyAttempts, err)
+
+		if attempt == notifyAttempts {
+			break
+		}
+
+		select {
+		case <-n.quit:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+
+		if n.superseded(zone, round) {
+			log.Debugf("NOTIFY for %s serial %d to %s superseded by a newer serial", zone, soa.Serial, target)
+			return
+		}
+	}
+
+	log.Errorf("giving up sending NOTIFY for %s serial %d to %s", zone, soa.Serial, target)
+}
+
+func (n *notifier) send(target, zone string, soa *dns.SOA) error {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	m.Authoritative = true
+	m.Answer = []dns.RR{soa}
+
+	c := &dns.Client{
+		Net:     "udp",
+		Timeout: 5 * time.Second,
+	}
+
+	if n.xfr.tsigName != "" {
+		c.TsigSecret = n.st.tsigSecret
+		m.SetTsig(n.xfr.tsigName, n.xfr.tsigAlgorithm, 300, time.Now().Unix())
+	}
+
+	r, _, err := c.Exchange(m, target)
+	if err != nil {
+		return err
+	}
+
+	if r.Opcode != dns.OpcodeNotify || r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("secondary responded with %s", dns.RcodeToString[r.Rcode])
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/namecoin/ncdns/util"
+)
+
+// ResolverConfigFormats lists the recursive resolvers for which
+// WriteResolverConfig can generate configuration.
+var ResolverConfigFormats = []string{"unbound", "bind", "knot", "dnsmasq"}
+
+// What a recursive resolver needs to know to resolve the zones served by
+// ncdns: where to send queries, and the trust anchor of each zone.
+type resolverConfig struct {
+	ip    net.IP
+	port  int
+	zones []string
+
+	// DS records by zone. Zones without any are configured as insecure.
+	ds map[string][]*dns.DS
+}
+
+// WriteResolverConfig writes configuration for a recursive resolver which
+// sends queries for the zones served according to cfg to ncdns, and validates
+// the answers using the DS records of the configured KSK. format is one of
+// ResolverConfigFormats.
+//
+// The running server is not contacted; the first address in cfg.Bind is
+// used, and the KSK is read from the files named by cfg.
+func WriteResolverConfig(w io.Writer, cfg *Config, format string) error {
+	rc, err := newResolverConfig(cfg.Bind, cfg.Anchors)
+	if err != nil {
+		return err
+	}
+
+	var ksks []*dns.DNSKEY
+	if cfg.KeyDir != "" {
+		km := &keyManager{dir: cfg.cpath(cfg.KeyDir)}
+		err = km.load()
+		if err != nil {
+			return err
+		}
+
+		for _, k := range km.keys {
+			if k.KSK {
+				ksks = append(ksks, k.dnskey)
+			}
+		}
+
+		if len(ksks) == 0 {
+			return fmt.Errorf("no keys have been generated in %s yet; start ncdns first", km.dir)
+		}
+	} else if cfg.PublicKey != "" {
+		ksk, err := readDNSKEY(cfg.cpath(cfg.PublicKey))
+		if err != nil {
+			return err
+		}
+
+		ksks = append(ksks, ksk)
+	}
+
+	for _, zone := range rc.zones {
+		rc.ds[zone] = dsSet(ksks, zone)
+	}
+
+	return rc.write(w, format)
+}
+
+// Writes resolver configuration for the running server, using the address of
+// its first DNS listener and its current keys.
+func (s *Server) writeResolverConfig(w io.Writer, format string) error {
+	addr := s.cfg.Bind
+	if len(s.udpConns) > 0 {
+		addr = s.udpConns[0].LocalAddr().String()
+	}
+
+	st := s.current()
+	_, ecfg := st.currentEngine()
+	rc, err := newResolverConfig(addr, st.cfg.Anchors)
+	if err != nil {
+		return err
+	}
+
+	for _, zone := range rc.zones {
+		if s.keys != nil {
+			rc.ds[zone] = s.keys.dsSet(zone)
+		} else if ecfg.KSK != nil {
+			rc.ds[zone] = dsSet([]*dns.DNSKEY{ecfg.KSK}, zone)
+		}
+	}
+
+	return rc.write(w, format)
+}
+
+func newResolverConfig(bind, anchors string) (*resolverConfig, error) {
+	addrs := splitAddrs(bind)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no bind address configured")
+	}
+
+	host, portStr, err := net.SplitHostPort(addrs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in bind address %q", addrs[0])
+	}
+
+	rc := &resolverConfig{
+		ip:   net.ParseIP(host),
+		port: port,
+		ds:   map[string][]*dns.DS{},
+	}
+
+	// A wildcard address is reachable via loopback.
+	switch {
+	case rc.ip == nil || rc.ip.Equal(net.IPv4zero):
+		rc.ip = net.IPv4(127, 0, 0, 1)
+	case rc.ip.Equal(net.IPv6unspecified):
+		rc.ip = net.IPv6loopback
+	}
+
+	as, err := util.ParseAnchors(anchors)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range as {
+		rc.zones = append(rc.zones, dns.Fqdn(a.Suffix))
+	}
+
+	return rc, nil
+}
+
+// Returns the SHA-256 DS records of ksks for zone.
+func dsSet(ksks []*dns.DNSKEY, zone string) []*dns.DS {
+	var dss []*dns.DS
+	for _, k := range ksks {
+		dnskey := *k
+		dnskey.Hdr.Name = zone
+		if ds := dnskey.ToDS(dns.SHA256); ds != nil {
+			dss = append(dss, ds)
+		}
+	}
+
+	return dss
+}
+
+func (rc *resolverConfig) write(w io.Writer, format string) error {
+	var lines []string
+	switch format {
+	case "unbound":
+		lines = rc.unbound()
+	case "bind":
+		lines = rc.bind()
+	case "knot":
+		lines = rc.knot()
+	case "dnsmasq":
+		lines = rc.dnsmasq()
+	default:
+		return fmt.Errorf("unknown resolver %q; must be one of %s", format, strings.Join(ResolverConfigFormats, ", "))
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+func dsFields(ds *dns.DS) string {
+	return fmt.Sprintf("%d %d %d %s", ds.KeyTag, ds.Algorithm, ds.DigestType, strings.ToUpper(ds.Digest))
+}
+
+func (rc *resolverConfig) unbound() []string {
+	lines := []string{"# Generated by ncdns.", "server:"}
+	if rc.ip.IsLoopback() {
+		lines = append(lines, "  do-not-query-localhost: no")
+	}
+
+	for _, zone := range rc.zones {
+		if len(rc.ds[zone]) == 0 {
+			lines = append(lines, fmt.Sprintf("  domain-insecure: %q", zone))
+		}
+		for _, ds := range rc.ds[zone] {
+			lines = append(lines, fmt.Sprintf("  trust-anchor: \"%s DS %s\"", zone, dsFields(ds)))
+		}
+	}
+
+	for _, zone := range rc.zones {
+		lines = append(lines,
+			"stub-zone:",
+			fmt.Sprintf("  name: %q", zone),
+			fmt.Sprintf("  stub-addr: %s@%d", rc.ip, rc.port),
+			"  stub-prime: no",
+			"  stub-first: no")
+	}
+
+	return lines
+}
+
+func (rc *resolverConfig) bind() []string {
+	lines := []string{"// Generated by ncdns."}
+
+	var insecure []string
+	var anchors []string
+	for _, zone := range rc.zones {
+		if len(rc.ds[zone]) == 0 {
+			insecure = append(insecure, fmt.Sprintf("%q;", zone))
+		}
+		for _, ds := range rc.ds[zone] {
+			anchors = append(anchors, fmt.Sprintf("\t%s static-ds %d %d %d \"%s\";",
+				zone, ds.KeyTag, ds.Algorithm, ds.DigestType, strings.ToUpper(ds.Digest)))
+		}
+	}
+
+	if len(insecure) > 0 {
+		lines = append(lines,
+			"// Add to the options block, since these zones are not signed:",
+			fmt.Sprintf("//   validate-except { %s };", strings.Join(insecure, " ")))
+	}
+
+	if len(anchors) > 0 {
+		lines = append(lines, "trust-anchors {")
+		lines = append(lines, anchors...)
+		lines = append(lines, "};")
+	}
+
+	if rc.port != 53 {
+		lines = append(lines,
+			fmt.Sprintf("// BIND can only query static-stub servers on port 53, so ncdns must also listen on %s port 53.", rc.ip))
+	}
+
+	// A static-stub zone, unlike a forward zone, is resolved iteratively
+	// from ncdns, so that referrals to the nameservers of domains are
+	// followed.
+	for _, zone := range rc.zones {
+		lines = append(lines,
+			fmt.Sprintf("zone %q {", zone),
+			"\ttype static-stub;",
+			fmt.Sprintf("\tserver-addresses { %s; };", rc.ip),
+			"};")
+	}
+
+	return lines
+}
+
+func (rc *resolverConfig) knot() []string {
+	lines := []string{
+		"-- Generated by ncdns.",
+		"-- Knot Resolver sends every query for these zones to ncdns and does not",
+		"-- follow referrals from it, so domains delegated to other nameservers with",
+		"-- NS records won't resolve.",
+	}
+
+	for _, zone := range rc.zones {
+		if len(rc.ds[zone]) == 0 {
+			lines = append(lines, fmt.Sprintf("trust_anchors.set_insecure({'%s'})", zone))
+		}
+		for _, ds := range rc.ds[zone] {
+			lines = append(lines, fmt.Sprintf("trust_anchors.add('%s DS %s')", zone, dsFields(ds)))
+		}
+
+		lines = append(lines, fmt.Sprintf("policy.add(policy.suffix(policy.STUB('%s@%d'), {todname('%s')}))",
+			rc.ip, rc.port, zone))
+	}
+
+	return lines
+}
+
+func (rc *resolverConfig) dnsmasq() []string {
+	lines := []string{
+		"# Generated by ncdns.",
+		"# dnsmasq forwards every query for these zones to ncdns and does not follow",
+		"# referrals from it, so domains delegated to other nameservers with NS",
+		"# records won't resolve.",
+	}
+
+	for _, zone := range rc.zones {
+		name := strings.TrimSuffix(zone, ".")
+		lines = append(lines,
+			fmt.Sprintf("server=/%s/%s#%d", name, rc.ip, rc.port),
+			// Names in these zones may legitimately resolve to private
+			// addresses, which stop-dns-rebind would otherwise reject.
+			fmt.Sprintf("rebind-domain-ok=/%s/", name))
+
+		if len(rc.ds[zone]) == 0 {
+			lines = append(lines, fmt.Sprintf("# %s is not signed; with dnssec enabled, answers for it may fail validation.", zone))
+		}
+		for _, ds := range rc.ds[zone] {
+			lines = append(lines, fmt.Sprintf("trust-anchor=%s,%d,%d,%d,%s",
+				name, ds.KeyTag, ds.Algorithm, ds.DigestType, strings.ToUpper(ds.Digest)))
+		}
+	}
+
+	return lines
+}
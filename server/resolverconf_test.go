@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestResolverConfigGolden(t *testing.T) {
+	rr, err := dns.NewRR("bit. 3600 IN DNSKEY 257 3 15 l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bit. is signed; bit.example.net. is not.
+	rc := &resolverConfig{
+		ip:    net.ParseIP("127.0.0.1"),
+		port:  5391,
+		zones: []string{"bit.", "bit.example.net."},
+		ds: map[string][]*dns.DS{
+			"bit.": dsSet([]*dns.DNSKEY{rr.(*dns.DNSKEY)}, "bit."),
+		},
+	}
+
+	for _, format := range ResolverConfigFormats {
+		var buf bytes.Buffer
+		err := rc.write(&buf, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		fn := filepath.Join("testdata", "resolverconf."+format)
+		if *updateGolden {
+			err = ioutil.WriteFile(fn, buf.Bytes(), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("%s: got:\n%s\nexpected:\n%s", format, buf.Bytes(), expected)
+		}
+	}
+
+	if err := rc.write(ioutil.Discard, "nonexistent"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
@@ -1,13 +1,18 @@
 package server
 
 import (
+	"context"
 	"crypto"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/hlandau/buildinfo"
@@ -17,54 +22,180 @@ import (
 
 	"github.com/namecoin/ncdns/backend"
 	"github.com/namecoin/ncdns/namecoin"
+	"github.com/namecoin/ncdns/util"
 )
 
 var log, Log = xlog.New("ncdns.server")
 
 type Server struct {
+	// The configuration the server was started with. Listener settings are
+	// always taken from here; everything else is taken from the current
+	// state, which is replaced when the configuration is reloaded.
 	cfg Config
 
-	engine       madns.Engine
+	stateMutex  sync.RWMutex
+	st          *state
+	started     bool
+	reloadMutex sync.Mutex
+
+	mux          *dns.ServeMux
+	udpConns     []net.PacketConn
+	tcpListeners []net.Listener
+	dotListeners []net.Listener
+	dnsServers   []*dns.Server
+	wgStart      sync.WaitGroup
+
+	// TSIG secrets by key name, for authenticating zone transfers.
+	tsigSecret map[string]string
+
+	// Managed DNSSEC keys, if KeyDir is set.
+	keys     *keyManager
+	keysQuit chan struct{}
+
+	httpServer *http.Server
+
+	// Stops the Firefox override sync started by StartBackgroundTasks, if
+	// any.
+	stopFirefoxSync func()
+
+	stopMutex sync.Mutex
+	stopping  bool
+}
+
+// The parts of a server which are rebuilt from its configuration when it is
+// reloaded.
+type state struct {
+	cfg Config
+
+	backend      *backend.Backend
 	namecoinConn *namecoin.Client
+	nameSource   backend.NameSource
+	snapshot     *backend.SnapshotSource
+	xfr          *xfrHandler
+	notifier     *notifier
+	tsigSecret   map[string]string
+	keys         *keyManager
+
+	// The engine and the configuration it was built with. Both are replaced
+	// when a new managed ZSK becomes active; see setZSK.
+	engineMutex  sync.RWMutex
+	engine       madns.Engine
+	engineConfig madns.EngineConfig
+
+	// Engines for DNS-over-TLS clients, built from engineConfig.
+	dotEngines *dotEngines
 
-	mux         *dns.ServeMux
-	udpServer   *dns.Server
-	udpConn     *net.UDPConn
-	tcpServer   *dns.Server
-	tcpListener net.Listener
-	wgStart     sync.WaitGroup
+	// Serves all DNS queries for this state, and all but zone transfers,
+	// respectively.
+	handler dns.Handler
+	queries dns.Handler
+
+	closeOnce sync.Once
 }
 
 type Config struct {
-	Bind           string `default:":53" usage:"Address to bind to (e.g. 0.0.0.0:53)"`
+	Bind           string `default:":53" usage:"Comma-separated list of addresses to bind to (e.g. 0.0.0.0:53,[::]:53); ignored if sockets are passed by systemd socket activation"`
+	DoTBind        string `default:"" usage:"Comma-separated list of addresses to serve DNS-over-TLS on (e.g. 0.0.0.0:853) (default: disabled)"`
+	DoTCertFile    string `default:"" usage:"Path to the PEM certificate chain for DNS-over-TLS"`
+	DoTKeyFile     string `default:"" usage:"Path to the PEM private key for DNS-over-TLS"`
 	PublicKey      string `default:"" usage:"Path to the DNSKEY KSK public key file"`
 	PrivateKey     string `default:"" usage:"Path to the KSK's corresponding private key file"`
 	ZonePublicKey  string `default:"" usage:"Path to the DNSKEY ZSK public key file; if one is not specified, a temporary one is generated on startup and used only for the duration of that process"`
 	ZonePrivateKey string `default:"" usage:"Path to the ZSK's corresponding private key file"`
 
-	NamecoinRPCUsername   string `default:"" usage:"Namecoin RPC username"`
-	NamecoinRPCPassword   string `default:"" usage:"Namecoin RPC password"`
-	NamecoinRPCAddress    string `default:"127.0.0.1:8336" usage:"Namecoin RPC server address"`
-	NamecoinRPCCookiePath string `default:"" usage:"Namecoin RPC cookie path (used if password is unspecified)"`
-	NamecoinRPCTimeout    int    `default:"1500" usage:"Timeout (in milliseconds) for Namecoin RPC requests"`
-	CacheMaxEntries       int    `default:"100" usage:"Maximum name cache entries"`
-	SelfName              string `default:"" usage:"The FQDN of this nameserver. If empty, a pseudo-hostname is generated."`
-	SelfIP                string `default:"127.127.127.127" usage:"The canonical IP address for this service"`
-
-	HTTPListenAddr string `default:"" usage:"Address for webserver to listen at (default: disabled)"`
+	KeyDir              string `default:"" usage:"Directory in which to generate and keep DNSSEC keys, which are then rolled over automatically; may not be used together with publickey or zonepublickey (default: disabled)"`
+	KeyAlgorithm        string `default:"ecdsap256sha256" usage:"Algorithm of the keys generated in keydir: ecdsap256sha256 or ed25519"`
+	ZSKRolloverInterval int    `default:"2592000" usage:"Time (in seconds) for which each ZSK in keydir is used before it is replaced (0: never)"`
+	ZSKPrePublish       int    `default:"172800" usage:"Time (in seconds) for which a new ZSK is published before it is used, and an old one after it is retired"`
+
+	NamecoinRPCUsername     string `default:"" usage:"Namecoin RPC username"`
+	NamecoinRPCPassword     string `default:"" usage:"Namecoin RPC password"`
+	NamecoinRPCAddress      string `default:"127.0.0.1:8336" usage:"Namecoin RPC server address"`
+	NamecoinRPCCookiePath   string `default:"" usage:"Namecoin RPC cookie path (used if password is unspecified)"`
+	NamecoinRPCTimeout      int    `default:"1500" usage:"Timeout (in milliseconds) for Namecoin RPC requests"`
+	NamesFile               string `default:"" usage:"Path to a JSON file mapping names (e.g. d/example) to values; names found there take precedence over Namecoin"`
+	NameSnapshot            string `default:"" usage:"Path to a name snapshot written by ncdumpzone -format=snapshot; if set, names are served from it instead of Namecoin Core, and it is reloaded when it changes"`
+	CacheMaxEntries         int    `default:"100" usage:"Maximum name cache entries"`
+	CacheMaxIsolationIDs    int    `default:"1000" usage:"Maximum number of stream isolation IDs to keep separate name caches for (0: no limit)"`
+	CacheIsolationIDTimeout int    `default:"3600" usage:"Time (in seconds) after which the name cache of an unused stream isolation ID is discarded (0: never)"`
+	NegativeCacheMaxEntries int    `default:"1000" usage:"Maximum entries in the cache of nonexistent names, per stream isolation ID (0: disable negative caching)"`
+	CacheMaxAge             int    `default:"600" usage:"Maximum age (in seconds) of a name cache entry, even if no new block has arrived (0: no limit)"`
+	ServeStale              int    `default:"0" usage:"Time (in seconds) for which cached names are kept after being fetched so they can be served, with a short TTL, if Namecoin RPC fails or times out (0: disabled)"`
+	ChainPollInterval       int    `default:"5000" usage:"Interval (in milliseconds) at which to poll Namecoin for new blocks; cached names are refetched whenever the chain tip changes (0: disabled)"`
+	ExpiryGracePeriod       int    `default:"0" usage:"Number of blocks after a name expires during which it continues to be served (0: expired names are treated as nonexistent)"`
+	SelfName                string `default:"" usage:"The FQDN of this nameserver. If empty, a pseudo-hostname is generated."`
+	SelfIP                  string `default:"127.127.127.127" usage:"The canonical IP address for this service"`
+
+	XFRAllow           string `default:"" usage:"Comma-separated list of IP addresses or CIDR ranges permitted to transfer the zone (AXFR/IXFR)"`
+	XFRTSIGKey         string `default:"" usage:"TSIG key permitting zone transfers, in the form [algorithm:]name:base64secret (default algorithm: hmac-sha256)"`
+	XFRJournalSize     int    `default:"4" usage:"Number of previous versions of each zone to keep for incremental zone transfers (IXFR)"`
+	NotifyTargets      string `default:"" usage:"Comma-separated list of secondary nameservers (host or host:port) to send NOTIFY to when a new block arrives; requires zone transfers to be enabled"`
+	NotifyCheckChanges bool   `default:"false" usage:"Walk the whole zone on every new block and send NOTIFY only if its contents changed"`
+
+	HTTPListenAddr  string `default:"" usage:"Address for webserver to listen at (default: disabled)"`
+	HTTPTLSCertFile string `default:"" usage:"Path to the PEM certificate chain with which the webserver serves HTTPS (default: serve plain HTTP)"`
+	HTTPTLSKeyFile  string `default:"" usage:"Path to the PEM private key with which the webserver serves HTTPS"`
+	ShutdownTimeout int    `default:"10" usage:"Time (in seconds) to wait for queries and zone transfers in progress to finish when stopping"`
 
 	CanonicalSuffix      string `default:"bit" usage:"Suffix to advertise via HTTP"`
+	Anchors              string `default:"bit" usage:"Comma-separated list of suffixes to serve Namecoin domain names under, each optionally followed by =namespace (default d/), e.g. bit,bit.example.net,test=d/"`
+	anchors              []util.Anchor
 	CanonicalNameservers string `default:"" usage:"Comma-separated list of nameservers to use for NS records. If blank, SelfName (or autogenerated pseudo-hostname) is used."`
 	canonicalNameservers []string
 	Hostmaster           string `default:"" usage:"Hostmaster e. mail address"`
+	PerDomainSOA         bool   `default:"false" usage:"Synthesize an SOA at the apex of every domain, using the hostmaster from its email field and the height of its last update as the serial; may not be used together with DNSSEC keys"`
 	VanityIPs            string `default:"" usage:"Comma separated list of IP addresses to place in A/AAAA records at the zone apex (default: don't add any records)"`
 	vanityIPs            []net.IP
+	SOARefresh           int    `default:"600" usage:"SOA refresh interval (in seconds) advertised at the zone apex"`
+	SOARetry             int    `default:"600" usage:"SOA retry interval (in seconds) advertised at the zone apex"`
+	SOAExpire            int    `default:"7200" usage:"SOA expire time (in seconds) advertised at the zone apex"`
+	SOAMinTTL            int    `default:"600" usage:"SOA minimum TTL (in seconds) advertised at the zone apex; also how long nonexistent names are cached"`
+	ApexTTL              int    `default:"86400" usage:"TTL (in seconds) of the SOA, NS and vanity A/AAAA records at the zone apex"`
+	SerialFile           string `default:"" usage:"File in which to record the SOA serial at the zone apex, so that it never decreases across restarts (default: disabled)"`
 	TplSet               string `default:"std" usage:"The template set to use"`
 	TplPath              string `default:"" usage:"The path to the tpl directory (empty: autodetect)"`
 
 	ConfigDir string // path to interpret filenames relative to
 }
 
+// DefaultConfig returns a Config in which every option has the value given by
+// its default tag, as it would if no configuration file or command line
+// options were given.
+func DefaultConfig() Config {
+	var cfg Config
+
+	v := reflect.ValueOf(&cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		def := t.Field(i).Tag.Get("default")
+		if def == "" {
+			continue
+		}
+
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(def)
+		case reflect.Int:
+			n, err := strconv.Atoi(def)
+			if err != nil {
+				panic(fmt.Sprintf("invalid default for %s: %v", t.Field(i).Name, err))
+			}
+			f.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(def)
+			if err != nil {
+				panic(fmt.Sprintf("invalid default for %s: %v", t.Field(i).Name, err))
+			}
+			f.SetBool(b)
+		default:
+			panic(fmt.Sprintf("unsupported type of option %s", t.Field(i).Name))
+		}
+	}
+
+	return cfg
+}
+
 func (cfg *Config) cpath(s string) string {
 	return filepath.Join(cfg.ConfigDir, s)
 }
@@ -74,6 +205,62 @@ var ncdnsVersion string
 func New(cfg *Config) (s *Server, err error) {
 	ncdnsVersion = buildinfo.VersionSummary("github.com/namecoin/ncdns", "ncdns")
 
+	s = &Server{
+		cfg:      *cfg,
+		keysQuit: make(chan struct{}),
+	}
+
+	if cfg.XFRTSIGKey != "" {
+		name, _, secret, err := parseTSIGKey(cfg.XFRTSIGKey)
+		if err != nil {
+			return nil, err
+		}
+
+		s.tsigSecret = map[string]string{name: secret}
+	}
+
+	if cfg.KeyDir != "" {
+		anchors, err := util.ParseAnchors(cfg.Anchors)
+		if err != nil {
+			return nil, err
+		}
+
+		var zones []string
+		for _, a := range anchors {
+			zones = append(zones, dns.Fqdn(a.Suffix))
+		}
+
+		s.keys, err = newKeyManager(cfg, zones)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.st, err = newState(cfg, s.tsigSecret, s.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux = dns.NewServeMux()
+	s.mux.Handle(".", s.st.handler)
+
+	err = s.openListeners(cfg)
+	if err != nil {
+		return
+	}
+
+	if cfg.HTTPListenAddr != "" {
+		s.httpServer, err = webStart(cfg.HTTPListenAddr, s)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Builds a state from cfg. The state is not started.
+func newState(cfg *Config, tsigSecret map[string]string, keys *keyManager) (_ *state, err error) {
 	// Connect to local namecoin core RPC server using HTTP POST mode.
 	connCfg := &rpcclient.ConnConfig{
 		Host:         cfg.NamecoinRPCAddress,
@@ -91,57 +278,149 @@ func New(cfg *Config) (s *Server, err error) {
 		return nil, err
 	}
 
-	s = &Server{
+	st := &state{
 		cfg:          *cfg,
 		namecoinConn: client,
+		nameSource:   client,
+		tsigSecret:   tsigSecret,
+		keys:         keys,
 	}
 
-	if s.cfg.CanonicalNameservers != "" {
-		s.cfg.canonicalNameservers = strings.Split(s.cfg.CanonicalNameservers, ",")
-		for i := range s.cfg.canonicalNameservers {
-			s.cfg.canonicalNameservers[i] = dns.Fqdn(s.cfg.canonicalNameservers[i])
+	defer func() {
+		if err != nil {
+			st.close()
 		}
+	}()
+
+	if cfg.NameSnapshot != "" {
+		ss, err := backend.NewSnapshotSource(st.cfg.cpath(cfg.NameSnapshot))
+		if err != nil {
+			return nil, err
+		}
+
+		st.snapshot = ss
+		st.nameSource = ss
 	}
 
-	if s.cfg.VanityIPs != "" {
-		vanityIPs := strings.Split(s.cfg.VanityIPs, ",")
+	if cfg.NamesFile != "" {
+		fs, err := backend.NewFileSource(st.cfg.cpath(cfg.NamesFile))
+		if err != nil {
+			return nil, err
+		}
+
+		st.nameSource = backend.MultiSource{fs, st.nameSource}
+	}
+
+	if st.cfg.CanonicalNameservers != "" {
+		st.cfg.canonicalNameservers = strings.Split(st.cfg.CanonicalNameservers, ",")
+		for i := range st.cfg.canonicalNameservers {
+			st.cfg.canonicalNameservers[i] = dns.Fqdn(st.cfg.canonicalNameservers[i])
+		}
+	}
+
+	st.cfg.anchors, err = util.ParseAnchors(st.cfg.Anchors)
+	if err != nil {
+		return nil, err
+	}
+
+	// cfg may be the configuration of an existing state.
+	st.cfg.vanityIPs = nil
+	if st.cfg.VanityIPs != "" {
+		vanityIPs := strings.Split(st.cfg.VanityIPs, ",")
 		for _, ips := range vanityIPs {
 			ip := net.ParseIP(ips)
 			if ip == nil {
 				return nil, fmt.Errorf("Couldn't parse IP: %s", ips)
 			}
-			s.cfg.vanityIPs = append(s.cfg.vanityIPs, ip)
+			st.cfg.vanityIPs = append(st.cfg.vanityIPs, ip)
 		}
 	}
 
+	if cfg.XFRAllow != "" || cfg.XFRTSIGKey != "" {
+		st.xfr, err = newXFRHandler(st)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var onChainTipChange func(height int64, hash string)
+	if cfg.NotifyTargets != "" {
+		if st.xfr == nil {
+			return nil, fmt.Errorf("NotifyTargets requires zone transfers to be enabled with XFRAllow or XFRTSIGKey")
+		}
+
+		st.notifier = newNotifier(st)
+		onChainTipChange = st.notifier.chainTipChanged
+	}
+
+	// A domain's SOA would make it the apex of a zone of its own, but the
+	// anchor zone doesn't delegate it, so signatures from the anchor's keys
+	// couldn't be validated beneath it.
+	if cfg.PerDomainSOA && (keys != nil || cfg.PublicKey != "" || cfg.ZonePublicKey != "") {
+		return nil, fmt.Errorf("PerDomainSOA may not be used together with DNSSEC keys")
+	}
+
+	serialFile := ""
+	if cfg.SerialFile != "" {
+		serialFile = st.cfg.cpath(cfg.SerialFile)
+	}
+
 	b, err := backend.New(&backend.Config{
-		NamecoinConn:         s.namecoinConn,
-		NamecoinTimeout:      cfg.NamecoinRPCTimeout,
-		CacheMaxEntries:      cfg.CacheMaxEntries,
-		SelfIP:               cfg.SelfIP,
-		Hostmaster:           cfg.Hostmaster,
-		CanonicalNameservers: s.cfg.canonicalNameservers,
-		VanityIPs:            s.cfg.vanityIPs,
+		NameSource:                st.nameSource,
+		NamecoinTimeout:           cfg.NamecoinRPCTimeout,
+		ExpiryGracePeriod:         cfg.ExpiryGracePeriod,
+		CacheMaxEntries:           cfg.CacheMaxEntries,
+		CacheMaxAge:               cfg.CacheMaxAge,
+		NegativeCacheMaxEntries:   cfg.NegativeCacheMaxEntries,
+		CacheMaxIsolations:        cfg.CacheMaxIsolationIDs,
+		CacheIsolationIdleTimeout: cfg.CacheIsolationIDTimeout,
+		ChainTipPollInterval:      cfg.ChainPollInterval,
+		ServeStale:                cfg.ServeStale,
+		SelfIP:                    cfg.SelfIP,
+		Hostmaster:                cfg.Hostmaster,
+		PerDomainSOA:              cfg.PerDomainSOA,
+		CanonicalNameservers:      st.cfg.canonicalNameservers,
+		VanityIPs:                 st.cfg.vanityIPs,
+		Anchors:                   st.cfg.anchors,
+		SOARefresh:                cfg.SOARefresh,
+		SOARetry:                  cfg.SOARetry,
+		SOAExpire:                 cfg.SOAExpire,
+		SOAMinTTL:                 cfg.SOAMinTTL,
+		ApexTTL:                   cfg.ApexTTL,
+		SerialFile:                serialFile,
+		OnChainTipChange:          onChainTipChange,
 	})
 	if err != nil {
 		return
 	}
 
+	st.backend = b
+
 	ecfg := &madns.EngineConfig{
 		Backend:       b,
 		VersionString: ncdnsVersion,
 	}
 
 	// key setup
+	if keys != nil {
+		if cfg.PublicKey != "" || cfg.ZonePublicKey != "" {
+			return nil, fmt.Errorf("KeyDir may not be used together with PublicKey or ZonePublicKey")
+		}
+
+		ksk, zsk := keys.signingKeys()
+		ecfg.KSK, ecfg.KSKPrivate = ksk.dnskey, ksk.privateKey
+		ecfg.ZSK, ecfg.ZSKPrivate = zsk.dnskey, zsk.privateKey
+	}
+
 	if cfg.PublicKey != "" {
-		ecfg.KSK, ecfg.KSKPrivate, err = s.loadKey(cfg.PublicKey, cfg.PrivateKey)
+		ecfg.KSK, ecfg.KSKPrivate, err = readKeyPair(cfg.cpath(cfg.PublicKey), cfg.cpath(cfg.PrivateKey))
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if cfg.ZonePublicKey != "" {
-		ecfg.ZSK, ecfg.ZSKPrivate, err = s.loadKey(cfg.ZonePublicKey, cfg.ZonePrivateKey)
+		ecfg.ZSK, ecfg.ZSKPrivate, err = readKeyPair(cfg.cpath(cfg.ZonePublicKey), cfg.cpath(cfg.ZonePrivateKey))
 		if err != nil {
 			return nil, err
 		}
@@ -151,112 +430,330 @@ func New(cfg *Config) (s *Server, err error) {
 		return nil, fmt.Errorf("Must specify ZSK if KSK is specified")
 	}
 
-	s.engine, err = madns.NewEngine(ecfg)
+	st.engine, err = madns.NewEngine(ecfg)
 	if err != nil {
 		return
 	}
 
-	s.mux = dns.NewServeMux()
-	s.mux.Handle(".", s.engine)
+	st.engineConfig = *ecfg
+	st.dotEngines = newDotEngines(cfg.CacheMaxIsolationIDs)
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", s.cfg.Bind)
-	if err != nil {
-		return
+	st.queries = st.queryHandler(stateEngine{st}, "")
+	st.handler = st.queries
+	if st.xfr != nil {
+		st.xfr.next = st.queries
+		st.handler = st.xfr
 	}
 
-	s.tcpListener, err = net.ListenTCP("tcp", tcpAddr)
+	return st, nil
+}
+
+// Returns the state's engine and the configuration it was built with.
+func (st *state) currentEngine() (madns.Engine, madns.EngineConfig) {
+	st.engineMutex.RLock()
+	defer st.engineMutex.RUnlock()
+
+	return st.engine, st.engineConfig
+}
+
+// Replaces the state's engine with one which signs with the given ZSK. The
+// rest of the state, including the backend's caches, is kept.
+func (st *state) setZSK(zsk *dns.DNSKEY, zskPrivate crypto.PrivateKey) error {
+	st.engineMutex.Lock()
+	defer st.engineMutex.Unlock()
+
+	ecfg := st.engineConfig
+	ecfg.ZSK, ecfg.ZSKPrivate = zsk, zskPrivate
+
+	e, err := madns.NewEngine(&ecfg)
 	if err != nil {
-		return
+		return err
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", s.cfg.Bind)
+	st.engine, st.engineConfig = e, ecfg
+	st.dotEngines.reset()
+	return nil
+}
+
+// Serves queries with the state's current engine.
+type stateEngine struct {
+	st *state
+}
+
+func (e stateEngine) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	engine, _ := e.st.currentEngine()
+	engine.ServeDNS(w, r)
+}
+
+// Reads a DNSKEY from the file fn, and its private key from privateFn.
+func readKeyPair(fn, privateFn string) (k *dns.DNSKEY, privatek crypto.PrivateKey, err error) {
+	k, err = readDNSKEY(fn)
 	if err != nil {
 		return
 	}
 
-	s.udpConn, err = net.ListenUDP("udp", udpAddr)
+	privatef, err := os.Open(privateFn)
 	if err != nil {
 		return
 	}
+	defer privatef.Close()
 
-	if cfg.HTTPListenAddr != "" {
-		err = webStart(cfg.HTTPListenAddr, s)
-		if err != nil {
-			return
-		}
-	}
-
+	privatek, err = k.ReadPrivateKey(privatef, privateFn)
 	return
 }
 
-func (s *Server) loadKey(fn, privateFn string) (k *dns.DNSKEY, privatek crypto.PrivateKey, err error) {
-	fn = s.cfg.cpath(fn)
-	privateFn = s.cfg.cpath(privateFn)
-
+func readDNSKEY(fn string) (*dns.DNSKEY, error) {
 	f, err := os.Open(fn)
 	if err != nil {
-		return
+		return nil, err
 	}
+	defer f.Close()
 
 	rr, err := dns.ReadRR(f, fn)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	k, ok := rr.(*dns.DNSKEY)
 	if !ok {
-		err = fmt.Errorf("Loaded record from key file, but it wasn't a DNSKEY")
-		return
+		return nil, fmt.Errorf("Loaded record from key file, but it wasn't a DNSKEY")
 	}
 
-	privatef, err := os.Open(privateFn)
-	if err != nil {
-		return
+	return k, nil
+}
+
+// Starts the state's background tasks.
+func (st *state) start() {
+	if st.notifier != nil {
+		go st.notifier.run()
 	}
+}
 
-	privatek, err = k.ReadPrivateKey(privatef, privateFn)
-	log.Fatale(err)
+// Stops the state's background tasks and closes its Namecoin RPC client.
+func (st *state) close() {
+	st.closeOnce.Do(func() {
+		if st.notifier != nil {
+			st.notifier.stop()
+		}
 
-	return
+		if st.backend != nil {
+			st.backend.Close()
+		}
+
+		if st.snapshot != nil {
+			st.snapshot.Close()
+		}
+
+		if st.namecoinConn != nil {
+			st.namecoinConn.Shutdown()
+		}
+	})
+}
+
+// Returns the server's current state.
+func (s *Server) current() *state {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+
+	return s.st
 }
 
 func (s *Server) Start() error {
-	s.wgStart.Add(2)
-	s.udpServer = s.runListener("udp")
-	s.tcpServer = s.runListener("tcp")
+	for _, pc := range s.udpConns {
+		s.runListener("udp", nil, pc)
+	}
+	for _, l := range s.tcpListeners {
+		s.runListener("tcp", l, nil)
+	}
+	for _, l := range s.dotListeners {
+		s.runListener("tcp-tls", l, nil)
+	}
 	s.wgStart.Wait()
 	log.Info("Listeners started")
 
+	s.stateMutex.Lock()
+	s.started = true
+	st := s.st
+	s.stateMutex.Unlock()
+
+	st.start()
+
+	if s.keys != nil {
+		go s.manageKeys()
+	}
+
 	return s.StartBackgroundTasks()
 }
 
+// Reload replaces the server's configuration with cfg, rebuilding the backend
+// and DNS engine while keeping the listeners open. If the new configuration
+// is invalid, an error is returned and the previous configuration remains in
+// use. Changes to the listener addresses, the TLS certificates, XFRTSIGKey
+// and the settings for managed keys only take effect on restart.
+func (s *Server) Reload(cfg *Config) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	if s.isStopping() {
+		return fmt.Errorf("server is stopping")
+	}
+
+	newCfg := *cfg
+	if newCfg.Bind != s.cfg.Bind || newCfg.HTTPListenAddr != s.cfg.HTTPListenAddr ||
+		newCfg.XFRTSIGKey != s.cfg.XFRTSIGKey || newCfg.DoTBind != s.cfg.DoTBind ||
+		newCfg.DoTCertFile != s.cfg.DoTCertFile || newCfg.DoTKeyFile != s.cfg.DoTKeyFile ||
+		newCfg.HTTPTLSCertFile != s.cfg.HTTPTLSCertFile || newCfg.HTTPTLSKeyFile != s.cfg.HTTPTLSKeyFile ||
+		newCfg.KeyDir != s.cfg.KeyDir || newCfg.KeyAlgorithm != s.cfg.KeyAlgorithm ||
+		newCfg.ZSKRolloverInterval != s.cfg.ZSKRolloverInterval || newCfg.ZSKPrePublish != s.cfg.ZSKPrePublish {
+		log.Warn("changes to bind, httplistenaddr, xfrtsigkey, the TLS settings and the managed key settings take effect only on restart")
+		newCfg.Bind = s.cfg.Bind
+		newCfg.HTTPListenAddr = s.cfg.HTTPListenAddr
+		newCfg.XFRTSIGKey = s.cfg.XFRTSIGKey
+		newCfg.DoTBind = s.cfg.DoTBind
+		newCfg.DoTCertFile = s.cfg.DoTCertFile
+		newCfg.DoTKeyFile = s.cfg.DoTKeyFile
+		newCfg.HTTPTLSCertFile = s.cfg.HTTPTLSCertFile
+		newCfg.HTTPTLSKeyFile = s.cfg.HTTPTLSKeyFile
+		newCfg.KeyDir = s.cfg.KeyDir
+		newCfg.KeyAlgorithm = s.cfg.KeyAlgorithm
+		newCfg.ZSKRolloverInterval = s.cfg.ZSKRolloverInterval
+		newCfg.ZSKPrePublish = s.cfg.ZSKPrePublish
+	}
+
+	err := s.replaceState(&newCfg)
+	if err != nil {
+		log.Errore(err, "invalid configuration; continuing with the previous one")
+		return err
+	}
+
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// Builds a state from cfg and replaces the current state with it. Must be
+// called with reloadMutex held.
+func (s *Server) replaceState(cfg *Config) error {
+	// The new state starts with an empty zone transfer journal, since the
+	// new configuration may change the contents of the zones; secondaries
+	// which request an incremental transfer receive the full zone instead.
+	st, err := newState(cfg, s.tsigSecret, s.keys)
+	if err != nil {
+		return err
+	}
+
+	s.stateMutex.Lock()
+	old := s.st
+	s.st = st
+	started := s.started
+	s.stateMutex.Unlock()
+
+	s.mux.Handle(".", st.handler)
+
+	if started {
+		st.start()
+
+		err = s.restartBackgroundTasks()
+		log.Errore(err, "couldn't restart background tasks")
+	}
+
+	// Queries already being answered using the old state are given time to
+	// finish before its Namecoin RPC client is closed.
+	time.AfterFunc(time.Duration(s.cfg.ShutdownTimeout)*time.Second, old.close)
+
+	return nil
+}
+
 func (s *Server) doRunListener(ds *dns.Server) {
 	err := ds.ActivateAndServe()
+	if s.isStopping() {
+		return
+	}
 	log.Fatale(err)
 }
 
-func (s *Server) runListener(net string) *dns.Server {
+func (s *Server) runListener(network string, l net.Listener, pc net.PacketConn) {
 	ds := &dns.Server{
-		Addr:    s.cfg.Bind,
-		Net:     net,
-		Handler: s.mux,
+		Net:        network,
+		Listener:   l,
+		PacketConn: pc,
+		Handler:    s.mux,
+		TsigSecret: s.tsigSecret,
 		NotifyStartedFunc: func() {
 			s.wgStart.Done()
 		},
 	}
-	switch net {
-	case "tcp":
-		ds.Listener = s.tcpListener
-	case "udp":
-		ds.PacketConn = s.udpConn
-	default:
-		panic("unreachable")
+
+	if pc != nil {
+		ds.Addr = pc.LocalAddr().String()
+	} else {
+		ds.Addr = l.Addr().String()
 	}
 
+	if network == "tcp-tls" {
+		ds.Handler = &dotHandler{s: s}
+	}
+
+	log.Infof("listening on %s (%s)", ds.Addr, network)
+
+	s.wgStart.Add(1)
+	s.dnsServers = append(s.dnsServers, ds)
 	go s.doRunListener(ds)
-	return ds
 }
 
+// Stop stops the server. The listeners are closed at once; queries and zone
+// transfers in progress are given up to ShutdownTimeout seconds to finish
+// before Stop stops waiting for them. Background tasks are stopped and the
+// Namecoin RPC client is shut down.
 func (s *Server) Stop() error {
-	return nil // TODO
+	s.stopMutex.Lock()
+	if s.stopping {
+		s.stopMutex.Unlock()
+		return nil
+	}
+	s.stopping = true
+	s.stopMutex.Unlock()
+
+	close(s.keysQuit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	var errs []error
+	for _, ds := range s.dnsServers {
+		errs = append(errs, ds.ShutdownContext(ctx))
+	}
+
+	// If the listeners were never started, they still need closing.
+	if len(s.dnsServers) == 0 {
+		errs = append(errs, s.closeListeners())
+	}
+
+	if s.httpServer != nil {
+		errs = append(errs, s.httpServer.Shutdown(ctx))
+	}
+
+	// Wait for any reload in progress, so that the state it installs is the
+	// one closed. Background tasks may use the Namecoin RPC client, so they
+	// are stopped before it is closed.
+	s.reloadMutex.Lock()
+	errs = append(errs, s.StopBackgroundTasks())
+	s.current().close()
+	s.reloadMutex.Unlock()
+
+	log.Info("Stopped")
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) isStopping() bool {
+	s.stopMutex.Lock()
+	defer s.stopMutex.Unlock()
+
+	return s.stopping
 }
@@ -6,3 +6,11 @@ package server
 func (s *Server) StartBackgroundTasks() error {
 	return nil
 }
+
+func (s *Server) StopBackgroundTasks() error {
+	return nil
+}
+
+func (s *Server) restartBackgroundTasks() error {
+	return nil
+}
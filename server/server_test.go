@@ -0,0 +1,23 @@
+package server
+
+import "testing"
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+
+	if cfg.Bind != ":53" {
+		t.Errorf("got bind %q, expected \":53\"", cfg.Bind)
+	}
+
+	if cfg.XFRJournalSize != 4 {
+		t.Errorf("got xfrjournalsize %d, expected 4", cfg.XFRJournalSize)
+	}
+
+	if cfg.TplSet != "std" {
+		t.Errorf("got tplset %q, expected \"std\"", cfg.TplSet)
+	}
+
+	if cfg.PerDomainSOA || cfg.Hostmaster != "" {
+		t.Errorf("options without a default should be zero: %v, %q", cfg.PerDomainSOA, cfg.Hostmaster)
+	}
+}
@@ -11,7 +11,7 @@ import (
 )
 
 func (s *Server) StartBackgroundTasks() error {
-	err := tlsoverridefirefoxsync.Start(s.namecoinConn, s.cfg.CanonicalSuffix)
+	err := s.startFirefoxSync()
 	if err != nil {
 		return fmt.Errorf("Couldn't start Firefox override sync: %s", err)
 	}
@@ -23,3 +23,43 @@ func (s *Server) StartBackgroundTasks() error {
 
 	return nil
 }
+
+func (s *Server) startFirefoxSync() error {
+	st := s.current()
+	fs, err := tlsoverridefirefoxsync.Start(st.namecoinConn, st.cfg.CanonicalSuffix)
+	if err != nil {
+		return err
+	}
+
+	s.stopFirefoxSync = fs.Stop
+	return nil
+}
+
+func (s *Server) stopFirefoxSyncTask() {
+	if s.stopFirefoxSync != nil {
+		s.stopFirefoxSync()
+		s.stopFirefoxSync = nil
+	}
+}
+
+func (s *Server) StopBackgroundTasks() error {
+	s.stopFirefoxSyncTask()
+
+	// TODO: tlsrestrictnsssync offers no way to stop its background
+	// thread, so it keeps running until the process exits. Once it gains
+	// one, call it here.
+	return nil
+}
+
+// Restarts the background tasks which use the Namecoin RPC client, so that
+// they pick up the client of a reloaded configuration.
+func (s *Server) restartBackgroundTasks() error {
+	s.stopFirefoxSyncTask()
+
+	err := s.startFirefoxSync()
+	if err != nil {
+		return fmt.Errorf("Couldn't restart Firefox override sync: %s", err)
+	}
+
+	return nil
+}
@@ -3,7 +3,7 @@ package server
 import denet "github.com/hlandau/degoutils/net"
 
 func (s *Server) ServerName() string {
-	n := s.cfg.SelfName
+	n := s.current().cfg.SelfName
 	if n == "" {
 		n = denet.Hostname()
 	}
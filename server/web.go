@@ -2,6 +2,8 @@ package server
 
 import "net/http"
 import "html/template"
+import "github.com/namecoin/ncdns/backend"
+import "github.com/namecoin/ncdns/namecoin"
 import "github.com/namecoin/ncdns/util"
 import "github.com/namecoin/ncdns/ncdomain"
 import "github.com/miekg/dns"
@@ -9,11 +11,15 @@ import "github.com/kr/pretty"
 import "path/filepath"
 import "time"
 import "strings"
+import "strconv"
 import "fmt"
+import "crypto/tls"
+import "bytes"
 
 var layoutTpl *template.Template
 var mainPageTpl *template.Template
 var lookupPageTpl *template.Template
+var statusPageTpl *template.Template
 
 func (s *Server) initTemplates() error {
 	if lookupPageTpl != nil {
@@ -32,6 +38,11 @@ func (s *Server) initTemplates() error {
 	}
 
 	lookupPageTpl, err = deriveTemplate(s.tplFilename("lookup"))
+	if err != nil {
+		return err
+	}
+
+	statusPageTpl, err = deriveTemplate(s.tplFilename("status"))
 	return err
 }
 
@@ -69,7 +80,8 @@ type layoutInfo struct {
 }
 
 func (ws *webServer) layoutInfo() *layoutInfo {
-	csparts := strings.SplitN(ws.s.cfg.CanonicalSuffix, ".", 2)
+	cfg := &ws.s.current().cfg
+	csparts := strings.SplitN(cfg.CanonicalSuffix, ".", 2)
 	cshtml := `<span id="logo1">` + csparts[0] + `</span>`
 	if len(csparts) > 1 {
 		cshtml = `<span id="logo1">` + csparts[0] + `</span><span id="logo2">.</span><span id="logo3">` + csparts[1] + `</span>`
@@ -83,12 +95,12 @@ func (ws *webServer) layoutInfo() *layoutInfo {
 	li := &layoutInfo{
 		SelfName:             ws.s.ServerName(),
 		Time:                 time.Now().Format("2006-01-02 15:04:05"),
-		CanonicalSuffix:      ws.s.cfg.CanonicalSuffix,
-		CanonicalNameservers: ws.s.cfg.canonicalNameservers,
-		Hostmaster:           ws.s.cfg.Hostmaster,
+		CanonicalSuffix:      cfg.CanonicalSuffix,
+		CanonicalNameservers: cfg.canonicalNameservers,
+		Hostmaster:           cfg.Hostmaster,
 		CanonicalSuffixHTML:  template.HTML(cshtml),
 		TLD:                  tld,
-		HasDNSSEC:            ws.s.cfg.ZonePublicKey != "",
+		HasDNSSEC:            cfg.ZonePublicKey != "" || cfg.KeyDir != "",
 	}
 
 	return li
@@ -112,6 +124,13 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 		NameParseError error
 		ExistenceError error
 		Expired        bool
+		HasMetadata    bool
+		Height         int64
+		ExpiresIn      int64
+		ValueError     string
+		At             string
+		AtHeight       int64
+		Historical     bool
 		Value          string
 		NCValue        *ncdomain.Value
 		NCValueFmt     fmt.Formatter
@@ -127,23 +146,64 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 		log.Infoe(err, "lookup page tpl")
 	}()
 
+	st := ws.s.current()
 	q := req.FormValue("q")
 	info.Query = q
-	info.BareName, info.NamecoinName, info.NameParseError = util.ParseFuzzyDomainNameNC(q)
+	var anchor *util.Anchor
+	info.BareName, info.NamecoinName, anchor, info.NameParseError = util.ParseFuzzyDomainNameAnchors(q, st.cfg.anchors)
 	if info.NameParseError != nil {
 		return
 	}
 
 	info.Advanced = (req.FormValue("adv") != "")
-	info.DomainName = info.BareName + ".bit."
+	info.DomainName = info.BareName + "." + anchor.Suffix + "."
 
 	info.JSONValue = req.FormValue("value")
 	info.Value = strings.Trim(info.JSONValue, " \t\r\n")
-	if info.Value == "" {
-		info.Value, info.ExistenceError = ws.s.namecoinConn.NameQuery(info.NamecoinName, "")
+	info.At = strings.TrimSpace(req.FormValue("at"))
+	resolve := st.resolveFunc
+	if info.Value == "" && info.At != "" {
+		// Historical lookup: the name and anything it imports are resolved
+		// as of the same block.
+		info.Historical = true
+		if !st.hasNameHistory() {
+			info.ExistenceError = fmt.Errorf("historical lookups need Namecoin Core with -namehistory")
+			return
+		}
+
+		info.AtHeight, info.ExistenceError = st.parseHeight(info.At)
+		if info.ExistenceError != nil {
+			return
+		}
+
+		resolve = func(name string) (string, error) {
+			return st.namecoinConn.NameQueryAt(name, info.AtHeight, "")
+		}
+
+		info.Value, info.ExistenceError = resolve(info.NamecoinName)
+		if info.ExistenceError != nil {
+			return
+		}
+	} else if info.Value == "" {
+		var md *namecoin.NameMetadata
+		if ms, ok := st.nameSource.(backend.NameMetadataSource); ok {
+			info.Value, md, info.ExistenceError = ms.NameQueryMetadata(info.NamecoinName, "")
+		} else {
+			info.Value, info.ExistenceError = st.nameSource.NameQuery(info.NamecoinName, "")
+		}
 		if info.ExistenceError != nil {
 			return
 		}
+
+		if md != nil && md.Height != 0 {
+			info.HasMetadata = true
+			info.Height, info.ExpiresIn, info.Expired = md.Height, md.ExpiresIn, md.Expired
+		}
+
+		if md != nil && md.ValueError != "" {
+			info.ValueError = md.ValueError
+			return
+		}
 	} else {
 		info.JSONMode = true
 	}
@@ -156,21 +216,85 @@ func (ws *webServer) handleLookup(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	info.NCValue = ncdomain.ParseValue(info.NamecoinName, info.Value, ws.resolveFunc, errorFunc)
+	info.NCValue = ncdomain.ParseValue(info.NamecoinName, info.Value, resolve, errorFunc)
 	if info.NCValue == nil {
 		return
 	}
 
 	info.NCValueFmt = pretty.Formatter(info.NCValue)
 
-	info.RRs, info.RRError = info.NCValue.RRsRecursive(nil, info.DomainName, "bit.")
+	info.RRs, info.RRError = info.NCValue.RRsRecursive(nil, info.DomainName, anchor.Suffix+".")
 	if len(info.ParseErrors) == 0 && info.RRError == nil {
 		info.Valid = true
 	}
 }
 
-func (ws *webServer) resolveFunc(name string) (string, error) {
-	return ws.s.namecoinConn.NameQuery(name, "")
+func (ws *webServer) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	st := ws.s.current()
+	info := struct {
+		layoutInfo
+		NameSnapshot string
+		TipHeight    int64
+		TipHash      string
+		Cache        backend.CacheStats
+	}{
+		layoutInfo:   *ws.layoutInfo(),
+		NameSnapshot: st.cfg.NameSnapshot,
+		Cache:        st.backend.CacheStats(),
+	}
+
+	info.TipHeight, info.TipHash = st.backend.ChainTip()
+
+	err := statusPageTpl.Execute(rw, &info)
+	log.Infoe(err, "status page tpl")
+}
+
+// Serves configuration for a recursive resolver, selected with the format
+// parameter (default unbound), which resolves our zones via this server.
+func (ws *webServer) handleResolverConf(rw http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format == "" {
+		format = "unbound"
+	}
+
+	var buf bytes.Buffer
+	err := ws.s.writeResolverConfig(&buf, format)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write(buf.Bytes())
+}
+
+// Returns true if names are served from Namecoin Core, which can be asked for
+// their history. Names from a snapshot or names file have none, and Namecoin
+// Core's history would disagree with them.
+func (st *state) hasNameHistory() bool {
+	return st.snapshot == nil && st.cfg.NamesFile == ""
+}
+
+// Interprets s, from the lookup page, as a block height or as a time (RFC 3339
+// or a date), returning the height of the last block at or before that time.
+func (st *state) parseHeight(s string) (int64, error) {
+	if height, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return height, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("not a block height or time: %q", s)
+	}
+
+	return st.namecoinConn.HeightAt(t)
+}
+
+func (st *state) resolveFunc(name string) (string, error) {
+	return st.backend.ResolveName(name)
 }
 
 func (ws *webServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -196,9 +320,9 @@ func clearAllCookies(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func webStart(listenAddr string, server *Server) error {
+func webStart(listenAddr string, server *Server) (*http.Server, error) {
 	if err := server.initTemplates(); err != nil {
-		return err
+		return nil, err
 	}
 
 	ws := &webServer{
@@ -208,15 +332,41 @@ func webStart(listenAddr string, server *Server) error {
 
 	ws.sm.HandleFunc("/", ws.handleRoot)
 	ws.sm.HandleFunc("/lookup", ws.handleLookup)
+	ws.sm.HandleFunc("/status", ws.handleStatus)
+	ws.sm.HandleFunc("/dns-query", ws.handleDNSQuery)
+	ws.sm.HandleFunc("/resolve", ws.handleDNSJSON)
+	ws.sm.HandleFunc("/resolverconf", ws.handleResolverConf)
 
-	s := http.Server{
+	s := &http.Server{
 		Addr:    listenAddr,
 		Handler: ws,
 	}
 
+	cfg := &server.cfg
+	useTLS := cfg.HTTPTLSCertFile != "" || cfg.HTTPTLSKeyFile != ""
+	if useTLS {
+		cert, err := tls.LoadX509KeyPair(cfg.cpath(cfg.HTTPTLSCertFile), cfg.cpath(cfg.HTTPTLSKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load HTTPS certificate: %s", err)
+		}
+
+		s.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
 	go func() {
-		err := s.ListenAndServe()
+		var err error
+		if useTLS {
+			err = s.ListenAndServeTLS("", "")
+		} else {
+			err = s.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
 		log.Errore(err, "HTTP server")
 	}()
-	return nil
+	return s, nil
 }
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/madns.v2/merr"
+)
+
+// Serves zone transfers (AXFR, RFC 5936, and IXFR, RFC 1995) so that ordinary
+// secondary nameservers can serve the Namecoin zones. All other queries are
+// passed on to next, which must be set before the handler is used.
+type xfrHandler struct {
+	st   *state
+	next dns.Handler
+
+	allow         []*net.IPNet
+	tsigName      string
+	tsigAlgorithm string
+
+	// Serializes zone walks, so that concurrent transfers share one walk.
+	walkMutex sync.Mutex
+
+	// Recent versions of each zone by apex, oldest first. Used to compute
+	// incremental transfers.
+	mutex    sync.Mutex
+	versions map[string][]*zoneVersion
+}
+
+// The complete contents of a zone at a given serial.
+type zoneVersion struct {
+	soa     *dns.SOA
+	rrs     []dns.RR
+	keys    map[string]struct{}
+	created time.Time
+}
+
+// Maximum total size of the records sent in a single transfer message. This
+// leaves plenty of room below the 64 KiB limit for headers and TSIG.
+const xfrMessageSize = 16384
+
+func newXFRHandler(st *state) (*xfrHandler, error) {
+	h := &xfrHandler{
+		st:       st,
+		versions: map[string][]*zoneVersion{},
+	}
+
+	for _, a := range strings.Split(st.cfg.XFRAllow, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		if !strings.Contains(a, "/") {
+			if strings.Contains(a, ":") {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse XFRAllow entry: %s", err)
+		}
+
+		h.allow = append(h.allow, ipnet)
+	}
+
+	if st.cfg.XFRTSIGKey != "" {
+		name, algorithm, _, err := parseTSIGKey(st.cfg.XFRTSIGKey)
+		if err != nil {
+			return nil, err
+		}
+
+		h.tsigName, h.tsigAlgorithm = name, algorithm
+	}
+
+	return h, nil
+}
+
+// Parses a TSIG key of the form "[algorithm:]name:secret", as accepted by
+// "dig -y". The secret is base64-encoded.
+func parseTSIGKey(key string) (name, algorithm, secret string, err error) {
+	parts := strings.Split(key, ":")
+	switch len(parts) {
+	case 2:
+		algorithm, name, secret = dns.HmacSHA256, parts[0], parts[1]
+	case 3:
+		algorithm, name, secret = dns.Fqdn(strings.ToLower(parts[0])), parts[1], parts[2]
+	default:
+		return "", "", "", fmt.Errorf("TSIG key must be of the form [algorithm:]name:secret")
+	}
+
+	switch algorithm {
+	case dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512:
+	default:
+		return "", "", "", fmt.Errorf("unsupported TSIG algorithm: %s", algorithm)
+	}
+
+	_, err = base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", "", "", fmt.Errorf("TSIG secret is not valid base64: %s", err)
+	}
+
+	return dns.Fqdn(strings.ToLower(name)), algorithm, secret, nil
+}
+
+func (h *xfrHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) != 1 || (r.Question[0].Qtype != dns.TypeAXFR && r.Question[0].Qtype != dns.TypeIXFR) {
+		h.next.ServeDNS(w, r)
+		return
+	}
+
+	q := r.Question[0]
+	if !h.allowed(w, r) {
+		log.Infof("refused zone transfer of %s to %s", q.Name, w.RemoteAddr())
+		h.reply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeRefused))
+		return
+	}
+
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if udp && q.Qtype == dns.TypeAXFR {
+		h.reply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeRefused))
+		return
+	}
+
+	v, err := h.zone(strings.ToLower(dns.Fqdn(q.Name)))
+	if err == merr.ErrNotInZone {
+		h.reply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeNotAuth))
+		return
+	} else if err != nil {
+		log.Errore(err, "couldn't prepare zone transfer of ", q.Name)
+		h.reply(w, r, new(dns.Msg).SetRcode(r, dns.RcodeServerFailure))
+		return
+	}
+
+	if q.Qtype == dns.TypeIXFR {
+		h.serveIXFR(w, r, v, udp)
+		return
+	}
+
+	log.Infof("serving AXFR of %s at serial %d to %s", q.Name, v.soa.Serial, w.RemoteAddr())
+	h.transfer(w, r, h.axfrRRs(v))
+}
+
+// A transfer is permitted if the request is signed with the configured TSIG
+// key, or comes from an address in the ACL.
+func (h *xfrHandler) allowed(w dns.ResponseWriter, r *dns.Msg) bool {
+	if tsig := r.IsTsig(); tsig != nil && h.tsigName != "" {
+		if w.TsigStatus() == nil && strings.EqualFold(tsig.Hdr.Name, h.tsigName) &&
+			strings.EqualFold(tsig.Algorithm, h.tsigAlgorithm) {
+			return true
+		}
+	}
+
+	var ip net.IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+
+	for _, ipnet := range h.allow {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *xfrHandler) serveIXFR(w dns.ResponseWriter, r *dns.Msg, cur *zoneVersion, udp bool) {
+	var clientSerial uint32
+	if len(r.Ns) == 0 {
+		h.reply(w, r, new(dns.Msg).SetRcodeFormatError(r))
+		return
+	}
+	if soa, ok := r.Ns[0].(*dns.SOA); ok {
+		clientSerial = soa.Serial
+	} else {
+		h.reply(w, r, new(dns.Msg).SetRcodeFormatError(r))
+		return
+	}
+
+	// The client is up to date (or ahead of us, which can happen after a
+	// restart following a reorganization). Over UDP, a lone SOA also tells
+	// a client which is behind to retry over TCP.
+	if clientSerial == cur.soa.Serial || serialGreater(clientSerial, cur.soa.Serial) || udp {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{cur.soa}
+		h.reply(w, r, m)
+		return
+	}
+
+	old := h.version(cur.soa.Hdr.Name, clientSerial)
+	if old == nil {
+		// RFC 1995 permits answering with a full transfer when no history
+		// is available.
+		log.Infof("serving IXFR of %s from unknown serial %d as AXFR to %s", cur.soa.Hdr.Name, clientSerial, w.RemoteAddr())
+		h.transfer(w, r, h.axfrRRs(cur))
+		return
+	}
+
+	rrs := ixfrRRs(old, cur)
+	log.Infof("serving IXFR of %s from serial %d to %d (%d records) to %s", cur.soa.Hdr.Name,
+		clientSerial, cur.soa.Serial, len(rrs)-4, w.RemoteAddr())
+	h.transfer(w, r, rrs)
+}
+
+// Returns the records of an incremental transfer from old to cur: the current
+// SOA, the old SOA followed by the records deleted since, the current SOA
+// followed by the records added, and the current SOA again.
+func ixfrRRs(old, cur *zoneVersion) []dns.RR {
+	rrs := []dns.RR{cur.soa, old.soa}
+	for _, rr := range old.rrs {
+		if _, ok := cur.keys[rr.String()]; !ok {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	rrs = append(rrs, cur.soa)
+	for _, rr := range cur.rrs {
+		if _, ok := old.keys[rr.String()]; !ok {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return append(rrs, cur.soa)
+}
+
+func (h *xfrHandler) axfrRRs(v *zoneVersion) []dns.RR {
+	rrs := make([]dns.RR, 0, len(v.rrs)+2)
+	rrs = append(rrs, v.soa)
+	rrs = append(rrs, v.rrs...)
+	rrs = append(rrs, v.soa)
+	return rrs
+}
+
+// Sends rrs as a sequence of messages.
+func (h *xfrHandler) transfer(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) {
+	ch := make(chan *dns.Envelope)
+	done := make(chan error, 1)
+
+	tr := new(dns.Transfer)
+	go func() {
+		done <- tr.Out(w, r, ch)
+	}()
+
+	// Out stops reading from ch if writing fails, so every send must also
+	// watch for it returning.
+	send := func(batch []dns.RR) error {
+		select {
+		case ch <- &dns.Envelope{RR: batch}:
+			return nil
+		case err := <-done:
+			return fmt.Errorf("transfer ended early: %v", err)
+		}
+	}
+
+	var err error
+	var batch []dns.RR
+	size := 0
+	for _, rr := range rrs {
+		l := dns.Len(rr)
+		if len(batch) > 0 && size+l > xfrMessageSize {
+			err = send(batch)
+			if err != nil {
+				break
+			}
+
+			batch, size = nil, 0
+		}
+
+		batch = append(batch, rr)
+		size += l
+	}
+
+	if err == nil {
+		err = send(batch)
+	}
+
+	close(ch)
+	if err == nil {
+		err = <-done
+	}
+
+	log.Errore(err, "zone transfer failed")
+	w.Close()
+}
+
+// Sends m in reply to r. As dns.Transfer does for the messages of a transfer,
+// the reply is signed if r was validly signed.
+func (h *xfrHandler) reply(w dns.ResponseWriter, r, m *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+
+	err := w.WriteMsg(m)
+	log.Infoe(err, "couldn't write response")
+}
+
+// Returns the current version of the zone at apex, walking the zone if the
+// chain tip has changed since it was last walked.
+func (h *xfrHandler) zone(apex string) (*zoneVersion, error) {
+	if v := h.latest(apex); v != nil {
+		return v, nil
+	}
+
+	h.walkMutex.Lock()
+	defer h.walkMutex.Unlock()
+
+	// Another transfer may have walked the zone while we waited.
+	if v := h.latest(apex); v != nil {
+		return v, nil
+	}
+
+	soa, rrs, err := h.st.backend.Zone(apex)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &zoneVersion{
+		soa:     soa,
+		keys:    make(map[string]struct{}, len(rrs)),
+		created: time.Now(),
+	}
+
+	for _, rr := range rrs {
+		k := rr.String()
+		if _, ok := v.keys[k]; ok {
+			continue
+		}
+
+		v.keys[k] = struct{}{}
+		v.rrs = append(v.rrs, rr)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	versions := h.versions[apex]
+	if n := len(versions); n > 0 && versions[n-1].soa.Serial == soa.Serial {
+		versions = versions[0 : n-1]
+	}
+
+	versions = append(versions, v)
+	if max := h.st.cfg.XFRJournalSize + 1; len(versions) > max {
+		versions = versions[len(versions)-max:]
+	}
+
+	h.versions[apex] = versions
+	return v, nil
+}
+
+// Returns the most recent version of the zone at apex if it is still current.
+func (h *xfrHandler) latest(apex string) *zoneVersion {
+	serial := h.st.backend.SOASerial()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	versions := h.versions[apex]
+	if len(versions) == 0 {
+		return nil
+	}
+
+	v := versions[len(versions)-1]
+	if v.soa.Serial != serial {
+		return nil
+	}
+
+	maxAge := time.Duration(h.st.cfg.CacheMaxAge) * time.Second
+	if maxAge > 0 && time.Since(v.created) > maxAge {
+		return nil
+	}
+
+	return v
+}
+
+// Returns the version of the zone at apex with the given serial, if it is
+// still known.
+func (h *xfrHandler) version(apex string, serial uint32) *zoneVersion {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, v := range h.versions[apex] {
+		if v.soa.Serial == serial {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// Serial number arithmetic (RFC 1982): returns true if s1 is greater than s2.
+func serialGreater(s1, s2 uint32) bool {
+	return s1 != s2 && s1-s2 < 1<<31
+}
+
+// Returns the current version of the zone at apex, and whether its contents
+// differ from those of the version before it.
+func (h *xfrHandler) zoneChanged(apex string) (v *zoneVersion, changed bool, err error) {
+	v, err = h.zone(apex)
+	if err != nil {
+		return nil, false, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var prev *zoneVersion
+	for i, pv := range h.versions[apex] {
+		if pv == v && i > 0 {
+			prev = h.versions[apex][i-1]
+		}
+	}
+
+	if prev == nil || len(prev.keys) != len(v.keys) {
+		return v, true, nil
+	}
+
+	for k := range v.keys {
+		if _, ok := prev.keys[k]; !ok {
+			return v, true, nil
+		}
+	}
+
+	return v, false, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSerialGreater(t *testing.T) {
+	tests := []struct {
+		s1, s2  uint32
+		greater bool
+	}{
+		{1, 1, false},
+		{2, 1, true},
+		{1, 2, false},
+		{0, 0xffffffff, true},
+		{0xffffffff, 0, false},
+		{0x7fffffff, 0, true},
+		{0x80000000, 0, false},
+		{0, 0x80000000, false},
+		{100, 0x80000064, false},
+	}
+
+	for _, tst := range tests {
+		if g := serialGreater(tst.s1, tst.s2); g != tst.greater {
+			t.Errorf("serialGreater(%d, %d) = %v, expected %v", tst.s1, tst.s2, g, tst.greater)
+		}
+	}
+}
+
+func testZoneVersion(t *testing.T, serial uint32, records ...string) *zoneVersion {
+	v := &zoneVersion{
+		soa: &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "bit.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600},
+			Ns:     "ns.example.",
+			Mbox:   "hostmaster.example.",
+			Serial: serial,
+		},
+		keys: map[string]struct{}{},
+	}
+
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.rrs = append(v.rrs, rr)
+		v.keys[rr.String()] = struct{}{}
+	}
+
+	return v
+}
+
+func TestIXFRRRs(t *testing.T) {
+	old := testZoneVersion(t, 10,
+		"bit. 600 IN NS ns.example.",
+		"a.bit. 600 IN A 192.0.2.1",
+		"b.bit. 600 IN A 192.0.2.2")
+	cur := testZoneVersion(t, 11,
+		"bit. 600 IN NS ns.example.",
+		"b.bit. 600 IN A 192.0.2.3",
+		"c.bit. 600 IN A 192.0.2.4")
+
+	expected := []string{
+		cur.soa.String(),
+		old.soa.String(),
+		"a.bit.\t600\tIN\tA\t192.0.2.1",
+		"b.bit.\t600\tIN\tA\t192.0.2.2",
+		cur.soa.String(),
+		"b.bit.\t600\tIN\tA\t192.0.2.3",
+		"c.bit.\t600\tIN\tA\t192.0.2.4",
+		cur.soa.String(),
+	}
+
+	rrs := ixfrRRs(old, cur)
+	if len(rrs) != len(expected) {
+		t.Fatalf("got %d records, expected %d: %v", len(rrs), len(expected), rrs)
+	}
+
+	for i, rr := range rrs {
+		if rr.String() != expected[i] {
+			t.Errorf("record %d: got %q, expected %q", i, rr.String(), expected[i])
+		}
+	}
+
+	// Without changes, only the SOAs remain.
+	if rrs := ixfrRRs(cur, cur); len(rrs) != 4 {
+		t.Errorf("got %d records for an unchanged zone, expected 4: %v", len(rrs), rrs)
+	}
+}
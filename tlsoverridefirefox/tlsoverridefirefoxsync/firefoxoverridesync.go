@@ -27,9 +27,16 @@ var (
 
 var log, Log = xlog.New("ncdns.tlsoverridefirefoxsync")
 
-var zoneData string
-var zoneDataReady = false
-var zoneDataMux sync.Mutex
+// Sync is a synchronization started by Start.
+type Sync struct {
+	zoneData      string
+	zoneDataReady bool
+	zoneDataMux   sync.Mutex
+
+	// Closed by Stop to end the sync goroutines.
+	quit      chan struct{}
+	closeOnce sync.Once
+}
 
 // Note: the reason for the Fatal reaction to errors is that, if we stop
 // syncing the override list, Firefox will continue trusting .bit certs that
@@ -37,42 +44,52 @@ var zoneDataMux sync.Mutex
 // situation, .bit domains must stop resolving until the issue is corrected.
 // Forcing ncdns to exit is the least complex way to achieve this.
 
-func watchZone(conn *namecoin.Client) {
+func (s *Sync) watchZone(conn *namecoin.Client) {
 	for {
 		var result bytes.Buffer
 
 		err := ncdumpzone.Dump(conn, &result, "firefox-override")
+		if err != nil && s.stopping() {
+			// The connection was most likely closed during shutdown.
+			return
+		}
 		log.Fatale(err, "Couldn't dump zone for Firefox override sync")
 
-		zoneDataMux.Lock()
-		zoneData = result.String()
-		zoneDataReady = true
-		zoneDataMux.Unlock()
+		s.zoneDataMux.Lock()
+		s.zoneData = result.String()
+		s.zoneDataReady = true
+		s.zoneDataMux.Unlock()
 
-		time.Sleep(10 * time.Minute)
+		if !s.sleep(10 * time.Minute) {
+			return
+		}
 	}
 }
 
-func watchProfile(suffix string) {
+func (s *Sync) watchProfile(suffix string) {
 	if firefoxProfileDirFlag.Value() == "" {
 		log.Fatal("Missing required config option tlsoverridefirefox.profiledir")
 	}
 
 	for {
 		if profileInUse() {
-			time.Sleep(1 * time.Second)
+			if !s.sleep(1 * time.Second) {
+				return
+			}
 			continue
 		}
 
 		// At this point we know that Firefox is not running.
 
-		zoneDataMux.Lock()
-		zoneDataReadyLocal := zoneDataReady
-		zoneDataLocal := zoneData
-		zoneDataMux.Unlock()
+		s.zoneDataMux.Lock()
+		zoneDataReadyLocal := s.zoneDataReady
+		zoneDataLocal := s.zoneData
+		s.zoneDataMux.Unlock()
 
 		if !zoneDataReadyLocal {
-			time.Sleep(1 * time.Second)
+			if !s.sleep(1 * time.Second) {
+				return
+			}
 			continue
 		}
 
@@ -109,7 +126,28 @@ func watchProfile(suffix string) {
 
 		log.Debug("Finished syncing zone to cert_override.txt")
 
-		time.Sleep(10 * time.Minute)
+		if !s.sleep(10 * time.Minute) {
+			return
+		}
+	}
+}
+
+// Sleeps for d, returning false early if Stop is called.
+func (s *Sync) sleep(d time.Duration) bool {
+	select {
+	case <-s.quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *Sync) stopping() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -124,11 +162,29 @@ func profileInUse() bool {
 
 // Start starts 2 background threads that synchronize the blockchain's TLSA
 // records to a Firefox profile's cert_override.txt.  It accepts a connection
-// to access Namecoin Core, as well as a host suffix (usually "bit").
-func Start(conn *namecoin.Client, suffix string) error {
-	if syncEnableFlag.Value() {
-		go watchZone(conn)
-		go watchProfile(suffix)
+// to access Namecoin Core, as well as a host suffix (usually "bit").  If
+// synchronization is not enabled, Start returns nil, on which Stop may still
+// be called.
+func Start(conn *namecoin.Client, suffix string) (*Sync, error) {
+	if !syncEnableFlag.Value() {
+		return nil, nil
+	}
+
+	s := &Sync{quit: make(chan struct{})}
+	go s.watchZone(conn)
+	go s.watchProfile(suffix)
+	return s, nil
+}
+
+// Stop signals the background threads started by Start to exit. A zone dump
+// in progress is abandoned once conn is shut down, so Stop should be called
+// before shutting down the connection passed to Start.
+func (s *Sync) Stop() {
+	if s == nil {
+		return
 	}
-	return nil
+
+	s.closeOnce.Do(func() {
+		close(s.quit)
+	})
 }
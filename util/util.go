@@ -57,61 +57,107 @@ func SplitDomainTail(name string) (tail, rest string) {
 //	"c.d.bit.x.y.z."     -> subname="c",     basename="d", rootname="bit.x.y.z"
 //	"a.b.c.d.bit.x.y.z." -> subname="a.b.c",     basename="d", rootname="bit.x.y.z"
 func SplitDomainByFloatingAnchor(qname, anchor string) (subname, basename, rootname string, err error) {
+	subname, basename, rootname, _, err = SplitDomainByFloatingAnchors(qname, []Anchor{{Suffix: anchor}})
+	return
+}
+
+// Like SplitDomainByFloatingAnchor, but accepts any of several anchors, each of
+// which may consist of several labels (e.g. "bit.example.net"). The rightmost
+// occurrence of any anchor is used; if more than one anchor begins at that
+// label, the longest is used. The anchor used is also returned.
+func SplitDomainByFloatingAnchors(qname string, anchors []Anchor) (subname, basename, rootname string, anchor *Anchor, err error) {
 	qname = strings.TrimRight(qname, ".")
 	parts := strings.Split(qname, ".")
-	if len(parts) < 2 {
-		if parts[0] != anchor {
-			err = merr.ErrNotInZone
-			return
-		}
-
-		rootname = parts[0]
-		return
-	}
 
 	for partIndex := len(parts) - 1; partIndex >= 0; partIndex-- {
-		v := parts[partIndex]
-
-		// scanning for rootname
-		if v == anchor {
-			if partIndex == 0 {
-				// partIndex is already zero, so we have something like bit.x.y.z.
-				rootname = qname
-				return
+		bestLen := 0
+		for i := range anchors {
+			alabels := strings.Split(anchors[i].Suffix, ".")
+			if len(alabels) <= bestLen || partIndex+len(alabels) > len(parts) {
+				continue
+			}
+
+			if strings.Join(parts[partIndex:partIndex+len(alabels)], ".") == anchors[i].Suffix {
+				anchor = &anchors[i]
+				bestLen = len(alabels)
 			}
+		}
+
+		if anchor == nil {
+			continue
+		}
 
-			rootname = strings.Join(parts[partIndex:], ".")
+		rootname = strings.Join(parts[partIndex:], ".")
+		if partIndex > 0 {
 			basename = parts[partIndex-1]
 			subname = strings.Join(parts[0:partIndex-1], ".")
-			return
 		}
+		return
 	}
 
 	err = merr.ErrNotInZone
 	return
 }
 
-// Convert a domain name basename (e.g. "example") to a Namecoin domain name
-// key name ("d/example").
-func BasenameToNamecoinKey(basename string) (string, error) {
-	if !ValidateDomainLabel(basename) {
-		return "", fmt.Errorf("invalid domain name")
+// An Anchor is a DNS suffix under which Namecoin domain names are served,
+// together with the Namecoin namespace they are taken from. For example, the
+// anchor with suffix "bit" and namespace "d/" serves d/example as example.bit.
+type Anchor struct {
+	Suffix    string
+	Namespace string
+}
+
+// The anchors used when none are configured.
+var DefaultAnchors = []Anchor{{Suffix: "bit", Namespace: "d/"}}
+
+// Parses a comma-separated list of anchors. Each item is a suffix, optionally
+// followed by "=" and a namespace (default "d/"), for example
+// "bit,bit.example.net,test=d/". An empty list yields DefaultAnchors.
+func ParseAnchors(s string) ([]Anchor, error) {
+	if strings.TrimSpace(s) == "" {
+		return append([]Anchor(nil), DefaultAnchors...), nil
 	}
-	return basenameToNamecoinKey(basename), nil
+
+	var anchors []Anchor
+	for _, item := range strings.Split(s, ",") {
+		suffix, namespace := item, "d/"
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			suffix, namespace = item[0:i], item[i+1:]
+		}
+
+		suffix = strings.ToLower(strings.Trim(strings.TrimSpace(suffix), "."))
+		namespace = strings.TrimSpace(namespace)
+		if !ValidateHostName(suffix) {
+			return nil, fmt.Errorf("invalid anchor suffix: %q", suffix)
+		}
+
+		if len(namespace) < 2 || !strings.HasSuffix(namespace, "/") || strings.Count(namespace, "/") != 1 {
+			return nil, fmt.Errorf("invalid anchor namespace: %q", namespace)
+		}
+
+		anchors = append(anchors, Anchor{Suffix: suffix, Namespace: namespace})
+	}
+
+	return anchors, nil
 }
 
-func basenameToNamecoinKey(basename string) string {
-	return "d/" + basename
+// Convert a domain name basename (e.g. "example") to a Namecoin name in the
+// anchor's namespace (e.g. "d/example").
+func (a *Anchor) BasenameToNamecoinKey(basename string) (string, error) {
+	if !ValidateDomainLabel(basename) {
+		return "", fmt.Errorf("invalid domain name")
+	}
+	return a.Namespace + basename, nil
 }
 
-// Convert a Namecoin domain name key name (e.g. "d/example") to a domain name
-// basename ("example").
-func NamecoinKeyToBasename(key string) (string, error) {
-	if !strings.HasPrefix(key, "d/") {
+// Convert a Namecoin name in the anchor's namespace (e.g. "d/example") to a
+// domain name basename ("example").
+func (a *Anchor) NamecoinKeyToBasename(key string) (string, error) {
+	if !strings.HasPrefix(key, a.Namespace) {
 		return "", fmt.Errorf("not a valid domain name key")
 	}
 
-	key = key[2:]
+	key = key[len(a.Namespace):]
 	if !ValidateDomainLabel(key) {
 		return "", fmt.Errorf("not a valid domain name key")
 	}
@@ -119,6 +165,18 @@ func NamecoinKeyToBasename(key string) (string, error) {
 	return key, nil
 }
 
+// Convert a domain name basename (e.g. "example") to a Namecoin domain name
+// key name ("d/example").
+func BasenameToNamecoinKey(basename string) (string, error) {
+	return DefaultAnchors[0].BasenameToNamecoinKey(basename)
+}
+
+// Convert a Namecoin domain name key name (e.g. "d/example") to a domain name
+// basename ("example").
+func NamecoinKeyToBasename(key string) (string, error) {
+	return DefaultAnchors[0].NamecoinKeyToBasename(key)
+}
+
 // An owner name is any technically valid DNS name. RFC 2181 permits binary
 // data in DNS labels (!), but this is ridiculous. The conventions which appear
 // to be enforced by web browsers are used.
@@ -242,29 +300,44 @@ func ValidateEmail(email string) bool {
 // Takes a name in the form "d/example" or "example.bit" and converts it to the
 // bareword "example". Returns an error if the input is in neither form.
 func ParseFuzzyDomainName(name string) (string, error) {
-	if strings.HasPrefix(name, "d/") {
-		return NamecoinKeyToBasename(name)
-	}
-	if len(name) > 0 && name[len(name)-1] == '.' {
-		name = name[0 : len(name)-1]
-	}
-	if strings.HasSuffix(name, ".bit") {
-		name = name[0 : len(name)-4]
-		if !ValidateDomainLabel(name) {
-			return "", fmt.Errorf("invalid domain name")
-		}
-		return name, nil
-	}
-	return "", fmt.Errorf("invalid domain name")
+	name, _, _, err := ParseFuzzyDomainNameAnchors(name, DefaultAnchors)
+	return name, err
 }
 
 func ParseFuzzyDomainNameNC(name string) (bareName string, namecoinKey string, err error) {
-	name, err = ParseFuzzyDomainName(name)
-	if err != nil {
-		return "", "", err
+	bareName, namecoinKey, _, err = ParseFuzzyDomainNameAnchors(name, DefaultAnchors)
+	return
+}
+
+// Like ParseFuzzyDomainNameNC, but accepts domain names under any of the given
+// anchors and Namecoin names in any of their namespaces. The anchor the name
+// was matched against is also returned; for a Namecoin name, this is the
+// first anchor with its namespace.
+func ParseFuzzyDomainNameAnchors(name string, anchors []Anchor) (bareName, namecoinKey string, anchor *Anchor, err error) {
+	for i := range anchors {
+		a := &anchors[i]
+		if strings.HasPrefix(name, a.Namespace) {
+			bareName, err = a.NamecoinKeyToBasename(name)
+			if err != nil {
+				return "", "", nil, err
+			}
+
+			return bareName, name, a, nil
+		}
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	for i := range anchors {
+		a := &anchors[i]
+		if strings.HasSuffix(name, "."+a.Suffix) {
+			bareName = name[0 : len(name)-len(a.Suffix)-1]
+			if ValidateDomainLabel(bareName) {
+				return bareName, a.Namespace + bareName, a, nil
+			}
+		}
 	}
 
-	return name, basenameToNamecoinKey(name), nil
+	return "", "", nil, fmt.Errorf("invalid domain name")
 }
 
 // © 2014 Hugo Landau <hlandau@devever.net>    GPLv3 or later
@@ -81,3 +81,95 @@ func TestSplitDomainByFloatingAnchor(t *testing.T) {
 		}
 	}
 }
+
+var testAnchors = []util.Anchor{
+	{Suffix: "bit", Namespace: "d/"},
+	{Suffix: "bit.example.net", Namespace: "d/"},
+	{Suffix: "test", Namespace: "dd/"},
+}
+
+type asitem struct {
+	input            string
+	expectedSubname  string
+	expectedBasename string
+	expectedRootname string
+	expectedAnchor   string
+	expectedError    error
+}
+
+var asitems = []asitem{
+	{"a.b.c.d.", "", "", "", "", merr.ErrNotInZone},
+	{"a.d.bit.", "a", "d", "bit", "bit", nil},
+	{"a.d.bit.example.net.", "a", "d", "bit.example.net", "bit.example.net", nil},
+	{"d.bit.example.org.", "", "d", "bit.example.org", "bit", nil},
+	{"bit.example.net.", "", "", "bit.example.net", "bit.example.net", nil},
+	{"a.d.test.", "a", "d", "test", "test", nil},
+	{"d.bit.test.", "", "bit", "test", "test", nil},
+}
+
+func TestSplitDomainByFloatingAnchors(t *testing.T) {
+	for i, it := range asitems {
+		subname, basename, rootname, anchor, err := util.SplitDomainByFloatingAnchors(it.input, testAnchors)
+		if subname != it.expectedSubname || basename != it.expectedBasename || rootname != it.expectedRootname {
+			t.Errorf("Item %d: got (%q, %q, %q), expected (%q, %q, %q)", i,
+				subname, basename, rootname, it.expectedSubname, it.expectedBasename, it.expectedRootname)
+		}
+		if err != it.expectedError {
+			t.Errorf("Item %d: error \"%s\" does not equal expected error \"%s\"", i, err, it.expectedError)
+		}
+		if err == nil && anchor.Suffix != it.expectedAnchor {
+			t.Errorf("Item %d: anchor \"%s\" does not equal expected anchor \"%s\"", i, anchor.Suffix, it.expectedAnchor)
+		}
+	}
+}
+
+func TestParseAnchors(t *testing.T) {
+	anchors, err := util.ParseAnchors("bit, Bit.Example.Net. ,test=dd/")
+	if err != nil {
+		t.Fatalf("couldn't parse anchors: %v", err)
+	}
+
+	if len(anchors) != len(testAnchors) {
+		t.Fatalf("unexpected anchors: %+v", anchors)
+	}
+	for i := range anchors {
+		if anchors[i] != testAnchors[i] {
+			t.Errorf("anchor %d: got %+v, expected %+v", i, anchors[i], testAnchors[i])
+		}
+	}
+
+	for _, s := range []string{"bit=d", "bit=", "bit=d/x/", "bit..net"} {
+		_, err = util.ParseAnchors(s)
+		if err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestParseFuzzyDomainNameAnchors(t *testing.T) {
+	tests := []struct {
+		input, bareName, namecoinKey, anchor string
+	}{
+		{"d/example", "example", "d/example", "bit"},
+		{"dd/example", "example", "dd/example", "test"},
+		{"example.bit", "example", "d/example", "bit"},
+		{"example.bit.example.net.", "example", "d/example", "bit.example.net"},
+		{"example.test", "example", "dd/example", "test"},
+		{"a.example.bit", "", "", ""},
+		{"example.com", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		bareName, namecoinKey, anchor, err := util.ParseFuzzyDomainNameAnchors(tt.input, testAnchors)
+		if tt.anchor == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.input)
+			}
+			continue
+		}
+
+		if err != nil || bareName != tt.bareName || namecoinKey != tt.namecoinKey || anchor.Suffix != tt.anchor {
+			t.Errorf("%q: got (%q, %q, %+v, %v)", tt.input, bareName, namecoinKey, anchor, err)
+		}
+	}
+}